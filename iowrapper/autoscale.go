@@ -0,0 +1,349 @@
+package iowrapper
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default bounds and settings used by Autoscaler.
+const (
+	DefaultMinChunkSize      = 64 * 1024
+	DefaultMaxChunkSize      = 64 * 1024 * 1024
+	DefaultTargetLatency     = 100 * time.Millisecond
+	DefaultAutoscaleInterval = 500 * time.Millisecond
+)
+
+// Autoscaler adapts the chunk size and the number of reader and processor workers while a run is in
+// progress. Pass it to StartChunkWorkers and StartChunkProcessors with WithAutoscale, or set
+// Pipeline.Autoscale; the chunk size and worker counts given to the stages become the starting
+// point and are clamped to the bounds.
+//
+// Every Interval it compares how long processors waited for chunks (starvation) with how long readers
+// waited to hand chunks over (backpressure). Starved processors get more readers, and fewer processors
+// when they are mostly idle; backpressure gets more processors, and fewer readers once processors
+// are at their maximum. The chunk size doubles while chunks take less than half of TargetLatency to
+// process, amortising per-chunk overhead, and halves while they take more than twice as long, which
+// spreads the work over more processors. The default splitter picks up a new chunk size right away;
+// a custom splitter picks it up with the next file.
+type Autoscaler struct {
+	// MinChunkSize and MaxChunkSize bound the chunk size. Default to DefaultMinChunkSize and
+	// DefaultMaxChunkSize.
+	MinChunkSize int
+	MaxChunkSize int
+	// MinReaders and MaxReaders bound the reader workers. Default to 1 and runtime.NumCPU().
+	MinReaders int
+	MaxReaders int
+	// MinProcessors and MaxProcessors bound the processor workers. Default to 1 and runtime.NumCPU().
+	MinProcessors int
+	MaxProcessors int
+	// TargetLatency is the processing time per chunk the chunk size is steered towards.
+	// Defaults to DefaultTargetLatency.
+	TargetLatency time.Duration
+	// Interval is the time between adjustments. Defaults to DefaultAutoscaleInterval.
+	Interval time.Duration
+	// OnResize, when set, is called after every adjustment that changed something. It may call State.
+	OnResize func(AutoscaleState)
+
+	chunkSize atomic.Int64
+
+	// Measurements since the last adjustment, in nanoseconds where they are durations.
+	processing atomic.Int64
+	processed  atomic.Int64
+	starved    atomic.Int64
+	blocked    atomic.Int64
+
+	mu         sync.Mutex
+	readers    *workerPool
+	processors *workerPool
+	started    bool
+}
+
+// AutoscaleState is the current chunk size and worker counts.
+type AutoscaleState struct {
+	ChunkSize  int
+	Readers    int
+	Processors int
+}
+
+// State returns the current chunk size and worker counts.
+func (a *Autoscaler) State() AutoscaleState {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.stateLocked()
+}
+
+func (a *Autoscaler) stateLocked() AutoscaleState {
+	s := AutoscaleState{ChunkSize: int(a.chunkSize.Load())}
+	if a.readers != nil {
+		s.Readers = a.readers.size()
+	}
+	if a.processors != nil {
+		s.Processors = a.processors.size()
+	}
+	return s
+}
+
+func (a *Autoscaler) chunkBounds() (int, int) {
+	lo, hi := a.MinChunkSize, a.MaxChunkSize
+	if lo <= 0 {
+		lo = DefaultMinChunkSize
+	}
+	if hi <= 0 {
+		hi = DefaultMaxChunkSize
+	}
+	return lo, max(lo, hi)
+}
+
+func (a *Autoscaler) readerBounds() (int, int) {
+	return workerBounds(a.MinReaders, a.MaxReaders)
+}
+
+func (a *Autoscaler) processorBounds() (int, int) {
+	return workerBounds(a.MinProcessors, a.MaxProcessors)
+}
+
+func workerBounds(lo, hi int) (int, int) {
+	lo = max(lo, 1)
+	if hi <= 0 {
+		hi = runtime.NumCPU()
+	}
+	return lo, max(lo, hi)
+}
+
+// currentChunkSize returns the chunk size readers should use, initialising it from initial.
+func (a *Autoscaler) currentChunkSize(initial int) int {
+	lo, hi := a.chunkBounds()
+	a.chunkSize.CompareAndSwap(0, int64(clamp(initial, lo, hi)))
+	return int(a.chunkSize.Load())
+}
+
+// attachReaders starts the reader pool with workers clamped to the bounds and puts it under control.
+func (a *Autoscaler) attachReaders(ctx context.Context, pool *workerPool, workers int) {
+	lo, hi := a.readerBounds()
+	a.attach(ctx, &a.readers, pool, clamp(workers, lo, hi))
+}
+
+// attachProcessors is attachReaders for the processor pool.
+func (a *Autoscaler) attachProcessors(ctx context.Context, pool *workerPool, workers int) {
+	lo, hi := a.processorBounds()
+	a.attach(ctx, &a.processors, pool, clamp(workers, lo, hi))
+}
+
+func (a *Autoscaler) attach(ctx context.Context, slot **workerPool, pool *workerPool, workers int) {
+	pool.start(workers)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	*slot = pool
+	if !a.started {
+		a.started = true
+		go a.control(ctx)
+	}
+}
+
+// control adjusts the pools every Interval until ctx is done or the attached pools have finished.
+func (a *Autoscaler) control(ctx context.Context) {
+	interval := a.Interval
+	if interval <= 0 {
+		interval = DefaultAutoscaleInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer func() {
+		// Detach the pools so that the Autoscaler can be used for another run.
+		a.mu.Lock()
+		a.started = false
+		a.readers, a.processors = nil, nil
+		a.mu.Unlock()
+	}()
+
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if !a.adjust(now.Sub(last)) {
+				return
+			}
+			last = now
+		}
+	}
+}
+
+// adjust applies one control step over the measurements of the last elapsed period. It reports
+// false once there is nothing left to control.
+func (a *Autoscaler) adjust(elapsed time.Duration) bool {
+	processing := a.processing.Swap(0)
+	processed := a.processed.Swap(0)
+	starved := a.starved.Swap(0)
+	blocked := a.blocked.Swap(0)
+
+	a.mu.Lock()
+	if (a.readers == nil || a.readers.finished()) && (a.processors == nil || a.processors.finished()) {
+		a.mu.Unlock()
+		return false
+	}
+	before := a.stateLocked()
+
+	if a.readers != nil && a.processors != nil && elapsed > 0 {
+		readers, processors := before.Readers, before.Processors
+		starvation := float64(starved) / (float64(processors) * float64(elapsed))
+		backpressure := float64(blocked) / (float64(readers) * float64(elapsed))
+		rlo, rhi := a.readerBounds()
+		plo, phi := a.processorBounds()
+
+		switch {
+		case backpressure > 0.25 && starvation < 0.25:
+			if processors < phi {
+				processors++
+			} else if readers > rlo {
+				readers--
+			}
+		case starvation > 0.25 && backpressure < 0.25:
+			if readers < rhi {
+				readers++
+			}
+			if starvation > 0.5 && processors > plo {
+				processors--
+			}
+		}
+		a.readers.resize(readers)
+		a.processors.resize(processors)
+	}
+
+	if processed > 0 {
+		target := a.TargetLatency
+		if target <= 0 {
+			target = DefaultTargetLatency
+		}
+		latency := time.Duration(processing / processed)
+		size := int(a.chunkSize.Load())
+		switch {
+		case latency < target/2:
+			size *= 2
+		case latency > target*2:
+			size /= 2
+		}
+		lo, hi := a.chunkBounds()
+		a.chunkSize.Store(int64(clamp(size, lo, hi)))
+	}
+
+	after := a.stateLocked()
+	a.mu.Unlock()
+
+	// The callback runs unlocked, so that it may call State.
+	if after != before && a.OnResize != nil {
+		a.OnResize(after)
+	}
+	return true
+}
+
+// Measurement hooks called by the stages; all are no-ops on a nil Autoscaler.
+
+func (a *Autoscaler) observeProcessing(d time.Duration) {
+	if a != nil {
+		a.processing.Add(int64(d))
+		a.processed.Add(1)
+	}
+}
+
+func (a *Autoscaler) observeStarved(d time.Duration) {
+	if a != nil {
+		a.starved.Add(int64(d))
+	}
+}
+
+func (a *Autoscaler) observeBlocked(d time.Duration) {
+	if a != nil {
+		a.blocked.Add(int64(d))
+	}
+}
+
+func clamp(v, lo, hi int) int {
+	return min(max(v, lo), hi)
+}
+
+// workerPool runs a resizable set of identical workers. A worker runs work until it returns; work
+// should call retire between items and return true as soon as it reports true, and return false
+// when it stops on its own because the input is exhausted or ctx is done. After the first such
+// exit the pool no longer grows.
+type workerPool struct {
+	work func(p *workerPool) bool
+
+	mu      sync.Mutex
+	target  int
+	running int
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+func newWorkerPool(work func(p *workerPool) bool) *workerPool {
+	return &workerPool{work: work}
+}
+
+func (p *workerPool) start(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.target = n
+	for p.running < n {
+		p.spawnLocked()
+	}
+}
+
+func (p *workerPool) spawnLocked() {
+	p.running++
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		if !p.work(p) {
+			p.mu.Lock()
+			p.running--
+			p.closed = true
+			p.mu.Unlock()
+		}
+	}()
+}
+
+// resize sets the number of workers. Extra workers exit after their current item.
+func (p *workerPool) resize(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || n < 1 {
+		return
+	}
+	p.target = n
+	for p.running < n {
+		p.spawnLocked()
+	}
+}
+
+// retire reports whether the calling worker should exit because the pool shrank.
+func (p *workerPool) retire() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running > p.target {
+		p.running--
+		return true
+	}
+	return false
+}
+
+func (p *workerPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.target
+}
+
+func (p *workerPool) finished() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// wait blocks until every worker has exited.
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}
@@ -0,0 +1,234 @@
+package iowrapper
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolResize(t *testing.T) {
+	items := make(chan int)
+	var running, peak atomic.Int64
+	pool := newWorkerPool(func(p *workerPool) bool {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			if cur := peak.Load(); n > cur {
+				peak.CompareAndSwap(cur, n)
+			}
+			if p.retire() {
+				return true
+			}
+			if _, ok := <-items; !ok {
+				return false
+			}
+		}
+	})
+	pool.start(2)
+
+	waitFor := func(want int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for running.Load() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("running = %d, want %d", running.Load(), want)
+			}
+			// Feed items so that workers get a chance to retire.
+			select {
+			case items <- 0:
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+
+	waitFor(2)
+	pool.resize(5)
+	waitFor(5)
+	pool.resize(1)
+	waitFor(1)
+	if pool.size() != 1 {
+		t.Fatalf("size = %d, want 1", pool.size())
+	}
+
+	close(items)
+	pool.wait()
+	if !pool.finished() {
+		t.Fatal("pool not finished after its input closed")
+	}
+	pool.resize(3)
+	if running.Load() != 0 {
+		t.Fatal("finished pool grew again")
+	}
+}
+
+func TestAutoscalerAdjust(t *testing.T) {
+	// The idle workers only wait to retire; done makes them exit when the test returns.
+	done := make(chan struct{})
+	var pools []*workerPool
+	defer func() {
+		close(done)
+		for _, p := range pools {
+			p.wait()
+		}
+	}()
+	idle := func(p *workerPool) bool {
+		for !p.retire() {
+			select {
+			case <-done:
+				return false
+			case <-time.After(time.Millisecond):
+			}
+		}
+		return true
+	}
+	newScaler := func() *Autoscaler {
+		a := &Autoscaler{
+			MinChunkSize:  1024,
+			MaxChunkSize:  8192,
+			MaxReaders:    3,
+			MaxProcessors: 4,
+			TargetLatency: 10 * time.Millisecond,
+		}
+		a.readers = newWorkerPool(idle)
+		a.readers.start(2)
+		a.processors = newWorkerPool(idle)
+		a.processors.start(2)
+		pools = append(pools, a.readers, a.processors)
+		a.currentChunkSize(2048)
+		return a
+	}
+	const period = time.Second
+
+	t.Run("backpressure adds processors", func(t *testing.T) {
+		a := newScaler()
+		for i := 0; i < 2; i++ {
+			a.observeBlocked(period) // half of the readers' time
+			a.adjust(period)
+		}
+		if s := a.State(); s.Processors != 4 || s.Readers != 2 {
+			t.Fatalf("state = %+v, want 4 processors and 2 readers", s)
+		}
+		a.observeBlocked(period)
+		a.adjust(period)
+		if s := a.State(); s.Processors != 4 || s.Readers != 1 {
+			t.Fatalf("state = %+v, want readers reduced once processors are maxed", s)
+		}
+	})
+
+	t.Run("starvation adds readers", func(t *testing.T) {
+		a := newScaler()
+		var resized []AutoscaleState
+		a.OnResize = func(s AutoscaleState) {
+			if a.State() != s {
+				t.Errorf("State() = %+v in OnResize, want %+v", a.State(), s)
+			}
+			resized = append(resized, s)
+		}
+		for i := 0; i < 3; i++ {
+			a.observeStarved(2 * period) // all of the processors' time
+			a.adjust(period)
+		}
+		if s := a.State(); s.Readers != 3 || s.Processors != 1 {
+			t.Fatalf("state = %+v, want 3 readers and 1 processor", s)
+		}
+		// Once at the bounds nothing changes, so OnResize is not called again.
+		if len(resized) != 1 {
+			t.Fatalf("OnResize called %d times, want 1: %+v", len(resized), resized)
+		}
+	})
+
+	t.Run("chunk size follows latency", func(t *testing.T) {
+		a := newScaler()
+		for i := 0; i < 4; i++ {
+			a.observeProcessing(time.Millisecond)
+			a.adjust(period)
+		}
+		if got := a.State().ChunkSize; got != 8192 {
+			t.Fatalf("chunk size = %d, want the 8192 maximum", got)
+		}
+		for i := 0; i < 4; i++ {
+			a.observeProcessing(100 * time.Millisecond)
+			a.adjust(period)
+		}
+		if got := a.State().ChunkSize; got != 1024 {
+			t.Fatalf("chunk size = %d, want the 1024 minimum", got)
+		}
+	})
+}
+
+func TestPipelineAutoscale(t *testing.T) {
+	const linesPerFile = 20000
+
+	_, files, cleanup := createFakeLogFiles(t, 3, linesPerFile)
+	defer cleanup()
+
+	var mu sync.Mutex
+	var states []AutoscaleState
+	scaler := &Autoscaler{
+		MinChunkSize:  2 * 1024,
+		MaxChunkSize:  256 * 1024,
+		MaxReaders:    3,
+		MaxProcessors: 4,
+		TargetLatency: 20 * time.Millisecond,
+		Interval:      10 * time.Millisecond,
+		OnResize: func(s AutoscaleState) {
+			mu.Lock()
+			states = append(states, s)
+			mu.Unlock()
+		},
+	}
+
+	sizes := make(map[int]bool)
+	next := make(map[string]int)
+	p := &Pipeline[FakeLogRecord]{
+		Sources:          files,
+		ReaderWorkers:    1,
+		ProcessorWorkers: 1,
+		ChunkSize:        2 * 1024,
+		Autoscale:        scaler,
+		Processor: func(chunk FileChunk) ([]FakeLogRecord, error) {
+			mu.Lock()
+			sizes[len(chunk.Chunk.Data)/1024] = true
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			return parseChunkToFakeLogRecords(chunk)
+		},
+		Sink: func(file string, items []FakeLogRecord) error {
+			for _, rec := range items {
+				if rec.Index != next[file] {
+					t.Errorf("%s: got record %d, want %d", file, rec.Index, next[file])
+				}
+				next[file]++
+			}
+			return nil
+		},
+	}
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	for _, file := range files {
+		if next[file] != linesPerFile {
+			t.Fatalf("%s: got %d records, want %d", file, next[file], linesPerFile)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(states) == 0 {
+		t.Fatal("autoscaler never adjusted anything")
+	}
+	grew := false
+	for _, s := range states {
+		if s.ChunkSize > 2*1024 {
+			grew = true
+		}
+		if s.Readers > 3 || s.Processors > 4 || s.ChunkSize > 256*1024 {
+			t.Fatalf("state %+v is out of bounds", s)
+		}
+	}
+	if !grew || len(sizes) < 2 {
+		t.Fatalf("chunk size never changed mid-run: states %+v, sizes %v", states, sizes)
+	}
+}
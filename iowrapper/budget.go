@@ -0,0 +1,129 @@
+package iowrapper
+
+import (
+	"context"
+	"sync"
+)
+
+// ReorderLimits caps how much work may be outstanding between the chunk workers and the ordered
+// collector. A chunk counts against the limits from the moment it is read until the collector has
+// handed it to the sink, so the limits cover chunks in flight as well as chunks waiting in the
+// reorder buffer. Zero means unlimited.
+type ReorderLimits struct {
+	// MaxChunksPerFile caps the outstanding chunks of a single file.
+	MaxChunksPerFile int
+	// MaxBytesPerFile caps the outstanding input bytes of a single file.
+	MaxBytesPerFile int64
+	// MaxChunks caps the outstanding chunks across all files.
+	MaxChunks int
+	// MaxBytes caps the outstanding input bytes across all files.
+	MaxBytes int64
+}
+
+func (l ReorderLimits) isZero() bool {
+	return l == ReorderLimits{}
+}
+
+// ReorderBudget enforces ReorderLimits. The same budget must be passed (via WithReorderBudget) to
+// StartChunkWorkers and to the ordered collector: workers block before emitting a chunk that would
+// exceed the limits and resume once the collector releases chunks that reached the sink.
+//
+// A file with no outstanding chunks may always emit one, even past the limits. This guarantees that
+// the chunk the collector is waiting for can be read, so the pipeline never deadlocks; the limits
+// may therefore be overshot by at most one chunk per reader worker.
+type ReorderBudget struct {
+	limits ReorderLimits
+
+	mu     sync.Mutex
+	chunks int
+	bytes  int64
+	files  map[string]*budgetUsage
+	wake   chan struct{}
+}
+
+type budgetUsage struct {
+	chunks int
+	bytes  int64
+}
+
+// NewReorderBudget returns a budget enforcing limits.
+func NewReorderBudget(limits ReorderLimits) *ReorderBudget {
+	return &ReorderBudget{
+		limits: limits,
+		files:  make(map[string]*budgetUsage),
+		wake:   make(chan struct{}),
+	}
+}
+
+// Outstanding returns the number of chunks and input bytes currently held against the budget.
+func (b *ReorderBudget) Outstanding() (chunks int, bytes int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.chunks, b.bytes
+}
+
+// acquire blocks until a chunk of n bytes from file fits into the budget or ctx is done.
+func (b *ReorderBudget) acquire(ctx context.Context, file string, n int) error {
+	for {
+		b.mu.Lock()
+		usage := b.files[file]
+		if usage == nil || usage.chunks == 0 || b.fits(usage, int64(n)) {
+			if usage == nil {
+				usage = &budgetUsage{}
+				b.files[file] = usage
+			}
+			usage.chunks++
+			usage.bytes += int64(n)
+			b.chunks++
+			b.bytes += int64(n)
+			b.mu.Unlock()
+			return nil
+		}
+		wake := b.wake
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+func (b *ReorderBudget) fits(usage *budgetUsage, n int64) bool {
+	l := b.limits
+	if l.MaxChunksPerFile > 0 && usage.chunks+1 > l.MaxChunksPerFile {
+		return false
+	}
+	if l.MaxBytesPerFile > 0 && usage.bytes+n > l.MaxBytesPerFile {
+		return false
+	}
+	if l.MaxChunks > 0 && b.chunks+1 > l.MaxChunks {
+		return false
+	}
+	if l.MaxBytes > 0 && b.bytes+n > l.MaxBytes {
+		return false
+	}
+	return true
+}
+
+// release returns a chunk of n bytes from file to the budget and wakes blocked workers.
+func (b *ReorderBudget) release(file string, n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	usage := b.files[file]
+	if usage == nil || usage.chunks == 0 {
+		return
+	}
+	usage.chunks--
+	usage.bytes -= int64(n)
+	b.chunks--
+	b.bytes -= int64(n)
+	if usage.chunks == 0 {
+		delete(b.files, file)
+	}
+
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
@@ -0,0 +1,130 @@
+package iowrapper
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReorderBudgetBlocksUntilRelease(t *testing.T) {
+	b := NewReorderBudget(ReorderLimits{MaxChunksPerFile: 2, MaxBytes: 100})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := b.acquire(ctx, "a", 10); err != nil {
+			t.Fatalf("acquire %d: %v", i, err)
+		}
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		_ = b.acquire(ctx, "a", 10)
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquire exceeded MaxChunksPerFile")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.release("a", 10)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("acquire did not resume after release")
+	}
+
+	if chunks, bytes := b.Outstanding(); chunks != 2 || bytes != 20 {
+		t.Fatalf("Outstanding() = %d, %d; want 2, 20", chunks, bytes)
+	}
+}
+
+func TestReorderBudgetIdleFileAlwaysProgresses(t *testing.T) {
+	b := NewReorderBudget(ReorderLimits{MaxBytes: 10})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := b.acquire(ctx, "a", 10); err != nil {
+		t.Fatal(err)
+	}
+	// "b" has nothing outstanding, so it may exceed the overall limit by one chunk.
+	if err := b.acquire(ctx, "b", 50); err != nil {
+		t.Fatalf("idle file blocked: %v", err)
+	}
+
+	short, cancelShort := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelShort()
+	if err := b.acquire(short, "b", 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected acquire to block past the limit, got %v", err)
+	}
+}
+
+func TestStreamOrderedWithReorderBudget(t *testing.T) {
+	const (
+		linesPerFile = 4000
+		readers      = 2
+		maxChunks    = 6
+	)
+
+	_, files, cleanup := createFakeLogFiles(t, 3, linesPerFile)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	budget := NewReorderBudget(ReorderLimits{MaxChunks: maxChunks})
+	opts := []StageOption{WithReorderBudget(budget)}
+
+	var peak atomic.Int64
+	var slowOnce sync.Map
+	processor := func(chunk FileChunk) ([]FakeLogRecord, error) {
+		// Hold back the first chunk of every file so later chunks pile up behind it.
+		if chunk.Chunk.Index == 0 {
+			if _, loaded := slowOnce.LoadOrStore(chunk.File, true); !loaded {
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+		if chunks, _ := budget.Outstanding(); int64(chunks) > peak.Load() {
+			peak.Store(int64(chunks))
+		}
+		return parseChunkToFakeLogRecords(chunk)
+	}
+
+	fileCh := StartFileProducer(ctx, files)
+	chunkCh, errCh := StartChunkWorkers(ctx, readers, 2*1024, fileCh, opts...)
+	processedCh := StartChunkProcessors[FakeLogRecord](ctx, 8, chunkCh, processor)
+
+	collected := make(map[string][]FakeLogRecord)
+	err := StreamOrdered(ctx, processedCh, func(file string, items []FakeLogRecord) error {
+		collected[file] = append(collected[file], items...)
+		return nil
+	}, opts...)
+	if err != nil {
+		t.Fatalf("StreamOrdered returned error: %v", err)
+	}
+	if err := CollectErrors(errCh); err != nil {
+		t.Fatalf("chunk worker error: %v", err)
+	}
+
+	if got := peak.Load(); got > maxChunks+readers {
+		t.Fatalf("outstanding chunks peaked at %d, limit %d + %d readers", got, maxChunks, readers)
+	}
+	if chunks, bytes := budget.Outstanding(); chunks != 0 || bytes != 0 {
+		t.Fatalf("budget not fully released: %d chunks, %d bytes", chunks, bytes)
+	}
+	for _, path := range files {
+		records := collected[path]
+		if len(records) != linesPerFile {
+			t.Fatalf("file %s expected %d records, got %d", path, linesPerFile, len(records))
+		}
+		for idx, rec := range records {
+			if rec.Index != idx {
+				t.Fatalf("record index mismatch for %s: got %d want %d", path, rec.Index, idx)
+			}
+		}
+	}
+}
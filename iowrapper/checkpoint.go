@@ -0,0 +1,336 @@
+package iowrapper
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultCheckpointInterval is the minimum time between automatic checkpoint saves.
+const DefaultCheckpointInterval = 5 * time.Second
+
+// FileProgress records how far a file got through the ordered collector.
+type FileProgress struct {
+	// LastChunk is the index of the last chunk that reached the sink, with every chunk before it.
+	LastChunk int `json:"last_chunk"`
+	// Offset is the byte offset (after decompression) right after LastChunk.
+	Offset int64 `json:"offset"`
+	// Lines is the number of lines before Offset.
+	Lines int64 `json:"lines"`
+	// Size and ModTime identify the version of the file the progress was recorded for.
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// fileStamp identifies a version of a file by its size and modification time.
+type fileStamp struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// statStamp returns the current stamp of file, looked up in fsys when it is not nil. A file that
+// cannot be stat'ed gets the zero stamp, which matches no recorded one.
+func statStamp(fsys fs.FS, file string) fileStamp {
+	var info fs.FileInfo
+	var err error
+	if fsys == nil {
+		info, err = os.Stat(file)
+	} else {
+		info, err = fs.Stat(fsys, file)
+	}
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{Size: info.Size(), ModTime: info.ModTime()}
+}
+
+func (s fileStamp) matches(other fileStamp) bool {
+	return s != (fileStamp{}) && s.Size == other.Size && s.ModTime.Equal(other.ModTime)
+}
+
+// Checkpoint persists pipeline progress to a JSON state file so that an interrupted run can resume.
+// Pass it to StartChunkWorkers and the ordered collector with WithCheckpoint, or set
+// Pipeline.Checkpoint. Completed files are skipped on the next run and in-flight files continue
+// right after their last contiguous chunk: uncompressed files seek to the saved offset, compressed
+// files are decompressed and discarded up to it. Every entry records the size and modification
+// time of the file; a file that was rotated, truncated or rewritten since is processed again from
+// the start. Under ContinueOnError, a file stops advancing at its first failed chunk, so the next
+// run processes the failed data again. Stdin is never checkpointed.
+type Checkpoint struct {
+	// Interval is the minimum time between automatic saves. Defaults to DefaultCheckpointInterval.
+	Interval time.Duration
+
+	path string
+
+	mu        sync.Mutex
+	completed map[string]fileStamp
+	files     map[string]FileProgress
+	// reading holds the stamps of the files read in this run and started the chunk index each of
+	// them resumed from, for the collector.
+	reading map[string]fileStamp
+	started map[string]int
+	dirty   bool
+	saved   time.Time
+}
+
+type checkpointState struct {
+	Completed map[string]fileStamp    `json:"completed"`
+	Files     map[string]FileProgress `json:"files"`
+}
+
+// LoadCheckpoint reads the state file at path. A missing file yields an empty checkpoint that will be
+// created on the first save.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	c := &Checkpoint{
+		path:      path,
+		completed: make(map[string]fileStamp),
+		files:     make(map[string]FileProgress),
+		reading:   make(map[string]fileStamp),
+		started:   make(map[string]int),
+		saved:     time.Now(),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read checkpoint: %w", err)
+	}
+
+	var state checkpointState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("parse checkpoint %s: %w", path, err)
+	}
+	for file, stamp := range state.Completed {
+		c.completed[file] = stamp
+	}
+	for file, progress := range state.Files {
+		c.files[file] = progress
+	}
+	return c, nil
+}
+
+// Completed reports whether file was recorded as fully processed, whether or not it changed since.
+func (c *Checkpoint) Completed(file string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.completed[file]
+	return ok
+}
+
+// Progress returns the recorded progress of a partially processed file.
+func (c *Checkpoint) Progress(file string) (FileProgress, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.files[file]
+	return p, ok
+}
+
+// Pending returns the files that have not been completed yet, keeping their order. Completed files
+// that changed since are pending again.
+func (c *Checkpoint) Pending(files []string) []string {
+	return c.PendingFS(nil, files)
+}
+
+// PendingFS is Pending for files in fsys.
+func (c *Checkpoint) PendingFS(fsys fs.FS, files []string) []string {
+	pending := make([]string, 0, len(files))
+	for _, file := range files {
+		if !c.done(fsys, file) {
+			pending = append(pending, file)
+		}
+	}
+	return pending
+}
+
+// done reports whether file was completed and has not changed since. A changed file loses its entry.
+func (c *Checkpoint) done(fsys fs.FS, file string) bool {
+	c.mu.Lock()
+	stamp, ok := c.completed[file]
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if statStamp(fsys, file).matches(stamp) {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.completed, file)
+	c.dirty = true
+	return false
+}
+
+// Save writes the state file atomically by writing a temporary file and renaming it into place.
+func (c *Checkpoint) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.saveLocked()
+}
+
+func (c *Checkpoint) saveLocked() error {
+	state := checkpointState{
+		Completed: c.completed,
+		Files:     c.files,
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode checkpoint: %w", err)
+	}
+	if err := writeFileAtomic(c.path, data); err != nil {
+		return fmt.Errorf("save checkpoint: %w", err)
+	}
+	c.dirty = false
+	c.saved = time.Now()
+	return nil
+}
+
+// start returns the chunk index, byte offset and line count a file should be read from, and records
+// the version of the file being read. Progress recorded for another version of the file is dropped.
+func (c *Checkpoint) start(fsys fs.FS, file string) (index int, offset, lines int64) {
+	if c == nil || file == "-" {
+		return 0, 0, 0
+	}
+	stamp := statStamp(fsys, file)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reading[file] = stamp
+	p, ok := c.files[file]
+	if ok && !stamp.matches(fileStamp{Size: p.Size, ModTime: p.ModTime}) {
+		delete(c.files, file)
+		c.dirty = true
+		ok = false
+	}
+	if !ok {
+		c.started[file] = 0
+		return 0, 0, 0
+	}
+	c.started[file] = p.LastChunk + 1
+	return p.LastChunk + 1, p.Offset, p.Lines
+}
+
+// firstChunk returns the chunk index the readers resumed file from.
+func (c *Checkpoint) firstChunk(file string) int {
+	if c == nil || file == "-" {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.started[file]
+}
+
+// advance records that chunk index of file, ending at offset end after lines lines, reached the sink.
+func (c *Checkpoint) advance(file string, index int, end, lines int64) error {
+	if file == "-" {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stamp := c.reading[file]
+	c.files[file] = FileProgress{LastChunk: index, Offset: end, Lines: lines, Size: stamp.Size, ModTime: stamp.ModTime}
+	c.dirty = true
+	return c.maybeSaveLocked()
+}
+
+// complete marks file as fully processed.
+func (c *Checkpoint) complete(file string) error {
+	if file == "-" {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.files, file)
+	c.completed[file] = c.reading[file]
+	delete(c.reading, file)
+	delete(c.started, file)
+	c.dirty = true
+	return c.maybeSaveLocked()
+}
+
+func (c *Checkpoint) maybeSaveLocked() error {
+	interval := c.Interval
+	if interval <= 0 {
+		interval = DefaultCheckpointInterval
+	}
+	if !c.dirty || time.Since(c.saved) < interval {
+		return nil
+	}
+	return c.saveLocked()
+}
+
+// writeFileAtomic replaces path with data so that readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// openReaderAt opens source like openReader and positions it at offset. Plain files that can seek
+// do so; everything else is decompressed and the data before offset is discarded. seeked reports
+// which of the two happened.
+func openReaderAt(fsys fs.FS, source string, size int, offset int64, wrap func(io.Reader) io.Reader) (reader *bufio.Reader, closer io.Closer, seeked bool, err error) {
+	if offset <= 0 {
+		reader, closer, err = openReader(fsys, source, size, wrap)
+		return reader, closer, false, err
+	}
+	if source != "-" {
+		file, err := openFile(fsys, source)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if seeker, ok := file.(io.Seeker); ok {
+			var header []byte
+			if sniffMagic(source) {
+				header = make([]byte, len(zstdMagic))
+				n, _ := io.ReadFull(file, header)
+				header = header[:n]
+			}
+			if detectCompression(source, header) == uncompressed {
+				if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+					file.Close()
+					return nil, nil, false, fmt.Errorf("seek to %d: %w", offset, err)
+				}
+				var r io.Reader = file
+				if wrap != nil {
+					r = wrap(file)
+				}
+				return bufio.NewReaderSize(r, size), file, true, nil
+			}
+		}
+		file.Close()
+	}
+
+	reader, closer, err = openReader(fsys, source, size, wrap)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if _, err := io.CopyN(io.Discard, reader, offset); err != nil {
+		closer.Close()
+		return nil, nil, false, fmt.Errorf("skip to %d: %w", offset, err)
+	}
+	return reader, closer, false, nil
+}
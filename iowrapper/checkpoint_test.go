@@ -0,0 +1,256 @@
+package iowrapper
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// gzipFile writes a gzipped copy of src next to it and returns its path.
+func gzipFile(t testing.TB, src string) string {
+	t.Helper()
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := src + ".gz"
+	if err := os.WriteFile(dst, gzipBytes(t, string(data)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dst
+}
+
+func TestCheckpointSaveAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	a, b, c := filepath.Join(dir, "a.log"), filepath.Join(dir, "b.log"), filepath.Join(dir, "c.log")
+	for _, file := range []string{a, b, c} {
+		if err := os.WriteFile(file, []byte("line\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cp, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("LoadCheckpoint on missing file: %v", err)
+	}
+	cp.start(nil, a)
+	cp.start(nil, b)
+	if err := cp.advance(a, 3, 4096, 120); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.complete(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Completed(b) || loaded.Completed(a) {
+		t.Fatalf("unexpected completed state")
+	}
+	info, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FileProgress{LastChunk: 3, Offset: 4096, Lines: 120, Size: info.Size(), ModTime: info.ModTime()}
+	got, ok := loaded.Progress(a)
+	if !ok || !got.ModTime.Equal(want.ModTime) {
+		t.Fatalf("Progress(a.log) = %+v, %v; want %+v", got, ok, want)
+	}
+	if got.ModTime = want.ModTime; got != want {
+		t.Fatalf("Progress(a.log) = %+v, want %+v", got, want)
+	}
+	if got := loaded.Pending([]string{a, b, c}); !reflect.DeepEqual(got, []string{a, c}) {
+		t.Fatalf("Pending = %v", got)
+	}
+	if index, offset, lines := loaded.start(nil, a); index != 4 || offset != 4096 || lines != 120 {
+		t.Fatalf("start(a.log) = %d, %d, %d", index, offset, lines)
+	}
+}
+
+func TestCheckpointRestartsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	a, b := filepath.Join(dir, "a.log"), filepath.Join(dir, "b.log")
+	for _, file := range []string{a, b} {
+		if err := os.WriteFile(file, []byte("line\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cp, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.start(nil, a)
+	cp.start(nil, b)
+	if err := cp.advance(a, 0, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.complete(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate both files: new content with a different size.
+	for _, file := range []string{a, b} {
+		if err := os.WriteFile(file, []byte("rotated\nfile\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loaded, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.Pending([]string{a, b}); !reflect.DeepEqual(got, []string{a, b}) {
+		t.Fatalf("Pending = %v, want both files", got)
+	}
+	if index, offset, lines := loaded.start(nil, a); index != 0 || offset != 0 || lines != 0 {
+		t.Fatalf("start(a.log) = %d, %d, %d, want a restart", index, offset, lines)
+	}
+	if _, ok := loaded.Progress(a); ok {
+		t.Fatal("expected the stale progress of a.log to be dropped")
+	}
+}
+
+func TestPipelineResumesFromCheckpoint(t *testing.T) {
+	const linesPerFile = 3000
+
+	_, files, cleanup := createFakeLogFiles(t, 3, linesPerFile)
+	defer cleanup()
+	sources := []string{files[0], gzipFile(t, files[1]), files[2]}
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	collected := make(map[string][]FakeLogRecord)
+	crash := errors.New("crash")
+	calls := 0
+
+	run := func(crashAfter int) error {
+		cp, err := LoadCheckpoint(statePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cp.Interval = -1
+		p := &Pipeline[FakeLogRecord]{
+			Sources:          sources,
+			ReaderWorkers:    2,
+			ProcessorWorkers: 4,
+			ChunkSize:        4 * 1024,
+			Checkpoint:       cp,
+			Processor:        parseChunkToFakeLogRecords,
+			Sink: func(file string, items []FakeLogRecord) error {
+				calls++
+				if crashAfter > 0 && calls > crashAfter {
+					return crash
+				}
+				collected[file] = append(collected[file], items...)
+				return nil
+			},
+		}
+		return p.Run(context.Background())
+	}
+
+	if err := run(20); !errors.Is(err, crash) {
+		t.Fatalf("expected simulated crash, got %v", err)
+	}
+	partial := 0
+	for _, records := range collected {
+		partial += len(records)
+	}
+	if partial == 0 || partial >= len(sources)*linesPerFile {
+		t.Fatalf("expected a partial first run, got %d records", partial)
+	}
+
+	if err := run(0); err != nil {
+		t.Fatalf("resumed run failed: %v", err)
+	}
+
+	for _, path := range sources {
+		records := collected[path]
+		if len(records) != linesPerFile {
+			t.Fatalf("file %s expected %d records after resume, got %d", path, linesPerFile, len(records))
+		}
+		for idx, rec := range records {
+			if rec.Index != idx {
+				t.Fatalf("record index mismatch for %s: got %d want %d", path, rec.Index, idx)
+			}
+		}
+	}
+
+	cp, err := LoadCheckpoint(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cp.Pending(sources); len(got) != 0 {
+		t.Fatalf("expected every file completed, pending %v", got)
+	}
+}
+
+func TestCheckpointKeepsFailedChunksPending(t *testing.T) {
+	const linesPerFile = 2000
+
+	_, files, cleanup := createFakeLogFiles(t, 2, linesPerFile)
+	defer cleanup()
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	procErr := errors.New("bad chunk")
+	run := func(failing bool) (map[string]int, error) {
+		cp, err := LoadCheckpoint(statePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		collected := make(map[string]int)
+		p := &Pipeline[FakeLogRecord]{
+			Sources:       files,
+			ChunkSize:     4 * 1024,
+			FailurePolicy: ContinueOnError,
+			Checkpoint:    cp,
+			Processor: func(chunk FileChunk) ([]FakeLogRecord, error) {
+				if failing && chunk.File == files[0] && chunk.Chunk.Index == 1 {
+					return nil, procErr
+				}
+				return parseChunkToFakeLogRecords(chunk)
+			},
+			Sink: func(file string, items []FakeLogRecord) error {
+				collected[file] += len(items)
+				return nil
+			},
+		}
+		return collected, p.Run(context.Background())
+	}
+
+	if _, err := run(true); !errors.Is(err, procErr) {
+		t.Fatalf("expected %v, got %v", procErr, err)
+	}
+	cp, err := LoadCheckpoint(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Completed(files[0]) || !cp.Completed(files[1]) {
+		t.Fatal("expected only the file without failures to be completed")
+	}
+	if p, ok := cp.Progress(files[0]); !ok || p.LastChunk != 0 {
+		t.Fatalf("progress of %s = %+v, %v; want it to stop before the failed chunk", files[0], p, ok)
+	}
+
+	collected, err := run(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := collected[files[1]]; ok {
+		t.Fatalf("completed file %s was processed again", files[1])
+	}
+	if collected[files[0]] == 0 || collected[files[0]] >= linesPerFile {
+		t.Fatalf("resumed %s with %d records, want the records from the failed chunk on", files[0], collected[files[0]])
+	}
+}
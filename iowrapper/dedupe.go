@@ -0,0 +1,433 @@
+package iowrapper
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"math"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Defaults used by Dedupe.
+const (
+	DefaultDedupeMemory      = 256 * 1024 * 1024
+	DefaultDedupePartitions  = 64
+	DefaultFalsePositiveRate = 0.001
+)
+
+// dedupeEntryOverhead approximates the memory a key costs in the exact set beyond its bytes: the
+// string header and the map's share of bucket space.
+const dedupeEntryOverhead = 64
+
+// dedupeBatchSize caps the number of items Flush passes to emit at once.
+const dedupeBatchSize = 4096
+
+// Dedupe drops items whose key was already seen, across all files of a run, keeping the first
+// occurrence. It is a sink stage: feed it with Run, or call Filter from Pipeline.Sink and Flush
+// after the pipeline has finished.
+//
+// In exact mode the keys are held in a hash set until it reaches MemoryLimit. Items with keys not
+// in the set after that are partitioned by key hash into Partitions compressed temporary files,
+// which Flush dedupes one at a time within the same limit, splitting partitions further as needed.
+// Spilling encodes the items with encoding/gob, so T must be gob-encodable. With Bloom set, keys are
+// tracked in a Bloom filter instead: memory is fixed and nothing spills, but a false positive drops
+// a unique item.
+//
+// Filter and Flush must not be called concurrently.
+type Dedupe[T any] struct {
+	// Key returns the identity of an item. Required.
+	Key func(T) string
+	// MemoryLimit is roughly the memory used by the exact set, in bytes. Defaults to
+	// DefaultDedupeMemory.
+	MemoryLimit int64
+	// Partitions is the number of spill files. Defaults to DefaultDedupePartitions.
+	Partitions int
+	// TempDir is where spill files are created. Defaults to os.TempDir().
+	TempDir string
+
+	// Bloom selects the probabilistic mode, sized for ExpectedItems distinct keys at
+	// FalsePositiveRate, which defaults to DefaultFalsePositiveRate.
+	Bloom             bool
+	ExpectedItems     uint64
+	FalsePositiveRate float64
+
+	seen  map[string]struct{}
+	size  int64
+	bloom *bloomFilter
+	parts []*dedupePartition
+	seed  maphash.Seed
+	stats map[string]*DedupeFileStats
+}
+
+// DedupeFileStats counts the items of one file.
+type DedupeFileStats struct {
+	Unique     int64
+	Duplicates int64
+	// Spilled counts the items whose fate was left to Flush; they are included in Unique or
+	// Duplicates once Flush has run.
+	Spilled int64
+}
+
+// dedupeRecord is an item spilled to a partition.
+type dedupeRecord[T any] struct {
+	File string
+	Item T
+}
+
+type dedupePartition struct {
+	path string
+	file *os.File
+	zw   *zstd.Encoder
+	enc  *gob.Encoder
+}
+
+func (d *Dedupe[T]) init() error {
+	if d.stats != nil {
+		return nil
+	}
+	if d.Key == nil {
+		return errors.New("iowrapper: dedupe needs Key")
+	}
+	d.stats = make(map[string]*DedupeFileStats)
+	d.seed = maphash.MakeSeed()
+	if d.Bloom {
+		if d.ExpectedItems == 0 {
+			return errors.New("iowrapper: bloom dedupe needs ExpectedItems")
+		}
+		rate := d.FalsePositiveRate
+		if rate <= 0 || rate >= 1 {
+			rate = DefaultFalsePositiveRate
+		}
+		d.bloom = newBloomFilter(d.ExpectedItems, rate)
+	} else {
+		d.seen = make(map[string]struct{})
+	}
+	return nil
+}
+
+func (d *Dedupe[T]) fileStats(file string) *DedupeFileStats {
+	s := d.stats[file]
+	if s == nil {
+		s = &DedupeFileStats{}
+		d.stats[file] = s
+	}
+	return s
+}
+
+// Filter returns the items of file whose keys have not been seen before. Once the exact set is full,
+// items with unseen keys are spilled instead and returned by Flush. items is left unmodified, as it
+// may be shared, for instance between the branches of a Tee.
+func (d *Dedupe[T]) Filter(file string, items []T) ([]T, error) {
+	if err := d.init(); err != nil {
+		return nil, err
+	}
+	if d.bloom == nil && d.seen == nil {
+		return nil, errors.New("iowrapper: dedupe filtered after Flush")
+	}
+	stats := d.fileStats(file)
+	kept := make([]T, 0, len(items))
+	for _, item := range items {
+		key := d.Key(item)
+		if d.bloom != nil {
+			if d.bloom.addNew(key) {
+				kept = append(kept, item)
+				stats.Unique++
+			} else {
+				stats.Duplicates++
+			}
+			continue
+		}
+		if _, ok := d.seen[key]; ok {
+			stats.Duplicates++
+			continue
+		}
+		if d.size < d.memoryLimit() {
+			d.seen[key] = struct{}{}
+			d.size += int64(len(key)) + dedupeEntryOverhead
+			kept = append(kept, item)
+			stats.Unique++
+			continue
+		}
+		if d.parts == nil {
+			d.parts = d.newPartitions()
+		}
+		if err := d.spill(d.parts, d.seed, key, dedupeRecord[T]{File: file, Item: item}); err != nil {
+			return kept, err
+		}
+		stats.Spilled++
+	}
+	return kept, nil
+}
+
+func (d *Dedupe[T]) memoryLimit() int64 {
+	if d.MemoryLimit <= 0 {
+		return DefaultDedupeMemory
+	}
+	return d.MemoryLimit
+}
+
+// newPartitions returns an empty set of spill partitions; their files are created on first use.
+func (d *Dedupe[T]) newPartitions() []*dedupePartition {
+	n := d.Partitions
+	if n <= 0 {
+		n = DefaultDedupePartitions
+	}
+	return make([]*dedupePartition, n)
+}
+
+// spill writes rec to the partition of parts selected by hashing key with seed.
+func (d *Dedupe[T]) spill(parts []*dedupePartition, seed maphash.Seed, key string, rec dedupeRecord[T]) error {
+	i := maphash.String(seed, key) % uint64(len(parts))
+	part := parts[i]
+	if part == nil {
+		f, err := os.CreateTemp(d.TempDir, "dedupe-part-*.gob.zst")
+		if err != nil {
+			return fmt.Errorf("create spill file: %w", err)
+		}
+		zw, err := zstd.NewWriter(f, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return fmt.Errorf("create spill file: %w", err)
+		}
+		part = &dedupePartition{path: f.Name(), file: f, zw: zw, enc: gob.NewEncoder(zw)}
+		parts[i] = part
+	}
+	if err := part.enc.Encode(&rec); err != nil {
+		return fmt.Errorf("write spill file: %w", err)
+	}
+	return nil
+}
+
+// Flush dedupes the spilled items one partition at a time and calls emit with the unique ones,
+// grouped by file. The exact set is released first, so that a partition gets the whole MemoryLimit;
+// a partition with more keys than fit is split again by a second hash. Flush ends the run: Filter
+// fails after it. The spill files are removed.
+func (d *Dedupe[T]) Flush(ctx context.Context, emit func(file string, items []T) error) error {
+	// Spilled keys were never added to the set, so it is of no use to the partitions.
+	d.seen, d.size = nil, 0
+	parts := d.parts
+	d.parts = nil
+	defer func() {
+		for _, part := range parts {
+			if part != nil {
+				part.close()
+				os.Remove(part.path)
+			}
+		}
+	}()
+	for i := 0; i < len(parts); i++ {
+		part := parts[i]
+		if part == nil {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		split, err := d.flushPartition(part, emit)
+		parts = append(parts, split...)
+		if err != nil {
+			return err
+		}
+		os.Remove(part.path)
+		parts[i] = nil
+	}
+	return nil
+}
+
+// flushPartition emits the unique items of part. Like Filter, it holds keys in a set until the set
+// reaches MemoryLimit and spills the items with unseen keys after that; those partitions are returned
+// to be flushed in turn.
+func (d *Dedupe[T]) flushPartition(part *dedupePartition, emit func(string, []T) error) ([]*dedupePartition, error) {
+	if err := part.close(); err != nil {
+		return nil, fmt.Errorf("write spill file: %w", err)
+	}
+	f, err := os.Open(part.path)
+	if err != nil {
+		return nil, fmt.Errorf("open spill file: %w", err)
+	}
+	defer f.Close()
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("open spill file: %w", err)
+	}
+	defer zr.Close()
+
+	// Keys of other partitions cannot occur here, so the set only has to hold this partition.
+	var (
+		seen  = make(map[string]struct{})
+		size  int64
+		split []*dedupePartition
+		seed  = maphash.MakeSeed()
+		file  string
+		batch []T
+	)
+	dec := gob.NewDecoder(zr)
+	for {
+		var rec dedupeRecord[T]
+		if err := dec.Decode(&rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return split, fmt.Errorf("read spill file: %w", err)
+		}
+		stats := d.fileStats(rec.File)
+		key := d.Key(rec.Item)
+		if _, ok := seen[key]; ok {
+			stats.Spilled--
+			stats.Duplicates++
+			continue
+		}
+		if size >= d.memoryLimit() {
+			if split == nil {
+				split = d.newPartitions()
+			}
+			if err := d.spill(split, seed, key, rec); err != nil {
+				return split, err
+			}
+			continue
+		}
+		seen[key] = struct{}{}
+		size += int64(len(key)) + dedupeEntryOverhead
+		stats.Spilled--
+		stats.Unique++
+		if (rec.File != file || len(batch) >= dedupeBatchSize) && len(batch) > 0 {
+			if err := emit(file, batch); err != nil {
+				return split, err
+			}
+			batch = nil
+		}
+		file = rec.File
+		batch = append(batch, rec.Item)
+	}
+	if len(batch) > 0 {
+		return split, emit(file, batch)
+	}
+	return split, nil
+}
+
+func (p *dedupePartition) close() error {
+	if p.file == nil {
+		return nil
+	}
+	err := p.zw.Close()
+	if cerr := p.file.Close(); err == nil {
+		err = cerr
+	}
+	p.file = nil
+	return err
+}
+
+// Run consumes in until it is closed, calls emit with the unique items of every chunk and finally
+// flushes the spilled items. A chunk error stops the run and is returned; the caller must then
+// cancel ctx so that the upstream stages exit.
+func (d *Dedupe[T]) Run(ctx context.Context, in <-chan ProcessedChunk[T], emit func(file string, items []T) error) error {
+	if err := d.init(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.Join(ctx.Err(), d.Discard())
+		case res, ok := <-in:
+			if !ok {
+				return d.Flush(ctx, emit)
+			}
+			if res.Err != nil {
+				return errors.Join(res.Err, d.Discard())
+			}
+			kept, err := d.Filter(res.File, res.Items)
+			if err == nil && len(kept) > 0 {
+				err = emit(res.File, kept)
+			}
+			if err != nil {
+				return errors.Join(err, d.Discard())
+			}
+		}
+	}
+}
+
+// Sink wraps next into a Pipeline.Sink that passes on the unique items only. Call Flush with next
+// once Pipeline.Run has returned, to emit the spilled items and remove the spill files, or Discard
+// when the run failed.
+func (d *Dedupe[T]) Sink(next func(file string, items []T) error) func(file string, items []T) error {
+	return func(file string, items []T) error {
+		kept, err := d.Filter(file, items)
+		if err == nil && len(kept) > 0 {
+			err = next(file, kept)
+		}
+		return err
+	}
+}
+
+// Discard ends a failed run: it removes the spill files without reading them. Like Flush, it ends
+// the run, so Filter fails after it.
+func (d *Dedupe[T]) Discard() error {
+	d.seen, d.size = nil, 0
+	var errs []error
+	for _, part := range d.parts {
+		if part == nil {
+			continue
+		}
+		part.close()
+		if err := os.Remove(part.path); err != nil {
+			errs = append(errs, fmt.Errorf("remove spill file: %w", err))
+		}
+	}
+	d.parts = nil
+	return errors.Join(errs...)
+}
+
+// Stats returns the counts per file so far.
+func (d *Dedupe[T]) Stats() map[string]DedupeFileStats {
+	out := make(map[string]DedupeFileStats, len(d.stats))
+	for file, s := range d.stats {
+		out[file] = *s
+	}
+	return out
+}
+
+// bloomFilter is a Bloom filter using double hashing over two seeded 64-bit hashes.
+type bloomFilter struct {
+	bits  []uint64
+	m     uint64
+	k     int
+	seed1 maphash.Seed
+	seed2 maphash.Seed
+}
+
+// newBloomFilter sizes a filter for n keys at false-positive rate p: m = -n ln p / (ln 2)^2 bits and
+// k = m/n ln 2 hash functions.
+func newBloomFilter(n uint64, p float64) *bloomFilter {
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	m = max(m, 64)
+	k := max(int(math.Round(float64(m)/float64(n)*math.Ln2)), 1)
+	return &bloomFilter{
+		bits:  make([]uint64, (m+63)/64),
+		m:     m,
+		k:     k,
+		seed1: maphash.MakeSeed(),
+		seed2: maphash.MakeSeed(),
+	}
+}
+
+// addNew adds key and reports whether it was definitely not in the filter before.
+func (b *bloomFilter) addNew(key string) bool {
+	h1 := maphash.String(b.seed1, key)
+	h2 := maphash.String(b.seed2, key) | 1
+	added := false
+	for i := 0; i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % b.m
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		if b.bits[word]&mask == 0 {
+			b.bits[word] |= mask
+			added = true
+		}
+	}
+	return added
+}
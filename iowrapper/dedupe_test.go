@@ -0,0 +1,259 @@
+package iowrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var lineItems = LineProcessor(func(line []byte, _ LinePos) (string, bool, error) {
+	return string(line), true, nil
+})
+
+// writeOverlappingFiles writes files whose lines overlap: file i holds the numbers i*offset up to
+// i*offset+count, so neighbouring files share count-offset lines.
+func writeOverlappingFiles(t *testing.T, files, count, offset int) []string {
+	t.Helper()
+	dir := t.TempDir()
+	var paths []string
+	for i := 0; i < files; i++ {
+		var b strings.Builder
+		for n := i * offset; n < i*offset+count; n++ {
+			fmt.Fprintf(&b, "item-%d\n", n)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("feed%d.txt", i))
+		if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func identity(s string) string { return s }
+
+func TestDedupeSink(t *testing.T) {
+	for _, memory := range []int64{0, 4 * 1024} {
+		t.Run(fmt.Sprintf("memory=%d", memory), func(t *testing.T) {
+			files := writeOverlappingFiles(t, 3, 1000, 600)
+			tempDir := t.TempDir()
+			d := &Dedupe[string]{Key: identity, MemoryLimit: memory, Partitions: 4, TempDir: tempDir}
+
+			seen := make(map[string]int)
+			collect := func(_ string, items []string) error {
+				for _, item := range items {
+					seen[item]++
+				}
+				return nil
+			}
+			p := &Pipeline[string]{
+				Sources:    files,
+				ChunkSize:  2048,
+				InputOrder: true,
+				Processor:  lineItems,
+				Sink:       d.Sink(collect),
+			}
+			if err := p.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			spilled := int64(0)
+			for _, s := range d.Stats() {
+				spilled += s.Spilled
+			}
+			if memory > 0 && spilled == 0 {
+				t.Fatal("expected items to spill")
+			}
+			if err := d.Flush(context.Background(), collect); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(seen) != 2200 {
+				t.Fatalf("got %d unique items, want 2200", len(seen))
+			}
+			for item, n := range seen {
+				if n != 1 {
+					t.Fatalf("%s emitted %d times", item, n)
+				}
+			}
+			stats := d.Stats()
+			want := []DedupeFileStats{{Unique: 1000}, {Unique: 600, Duplicates: 400}, {Unique: 600, Duplicates: 400}}
+			for i, file := range files {
+				if stats[file] != want[i] {
+					t.Fatalf("%s: stats %+v, want %+v", file, stats[file], want[i])
+				}
+			}
+			if entries, _ := os.ReadDir(tempDir); len(entries) != 0 {
+				t.Fatalf("spill files left behind: %v", entries)
+			}
+		})
+	}
+}
+
+func TestDedupeRun(t *testing.T) {
+	files := writeOverlappingFiles(t, 4, 500, 250)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	chunks, errCh := StartChunkWorkers(ctx, 2, 1024, StartFileProducer(ctx, files))
+	processed := StartChunkProcessors(ctx, 2, chunks, lineItems)
+
+	d := &Dedupe[string]{Key: identity, MemoryLimit: 2048, TempDir: t.TempDir()}
+	total := 0
+	if err := d.Run(ctx, processed, func(_ string, items []string) error {
+		total += len(items)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CollectErrors(errCh); err != nil {
+		t.Fatal(err)
+	}
+	if total != 1250 {
+		t.Fatalf("got %d unique items, want 1250", total)
+	}
+	var dups int64
+	for _, s := range d.Stats() {
+		dups += s.Duplicates
+	}
+	if dups != 750 {
+		t.Fatalf("counted %d duplicates, want 750", dups)
+	}
+}
+
+func TestDedupeBloom(t *testing.T) {
+	const distinct = 20000
+	d := &Dedupe[string]{Key: identity, Bloom: true, ExpectedItems: distinct, FalsePositiveRate: 0.01}
+
+	var items []string
+	for i := 0; i < distinct; i++ {
+		items = append(items, fmt.Sprintf("item-%d", i))
+	}
+	kept, err := d.Filter("a", items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// False positives may drop unique items; allow twice the configured rate.
+	if lost := distinct - len(kept); lost > distinct/50 {
+		t.Fatalf("lost %d unique items to false positives", lost)
+	}
+
+	again := make([]string, 0, distinct)
+	for i := 0; i < distinct; i++ {
+		again = append(again, fmt.Sprintf("item-%d", i))
+	}
+	kept, err = d.Filter("b", again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 0 {
+		t.Fatalf("Bloom mode let %d duplicates through", len(kept))
+	}
+	if s := d.Stats()["b"]; s.Duplicates != distinct {
+		t.Fatalf("stats for b: %+v", s)
+	}
+
+	if _, err := (&Dedupe[string]{Key: identity, Bloom: true}).Filter("a", items); err == nil {
+		t.Fatal("expected an error without ExpectedItems")
+	}
+	if _, err := (&Dedupe[string]{}).Filter("a", items); err == nil {
+		t.Fatal("expected an error without Key")
+	}
+}
+
+func TestDedupeFilterLeavesItems(t *testing.T) {
+	d := &Dedupe[string]{Key: identity}
+	items := []string{"a", "a", "b"}
+	kept, err := d.Filter("f", items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 2 || kept[0] != "a" || kept[1] != "b" {
+		t.Fatalf("kept = %v, want [a b]", kept)
+	}
+	if items[0] != "a" || items[1] != "a" || items[2] != "b" {
+		t.Fatalf("Filter modified its input: %v", items)
+	}
+}
+
+func TestDedupeFlushSplitsLargePartitions(t *testing.T) {
+	tempDir := t.TempDir()
+	// A single partition and a set of a few dozen keys force Flush to split the spilled items.
+	d := &Dedupe[string]{Key: identity, MemoryLimit: 2048, Partitions: 1, TempDir: tempDir}
+
+	seen := make(map[string]int)
+	collect := func(_ string, items []string) error {
+		for _, item := range items {
+			seen[item]++
+		}
+		return nil
+	}
+	for _, file := range []string{"a", "b"} {
+		var items []string
+		for i := 0; i < 2000; i++ {
+			items = append(items, fmt.Sprintf("item-%d", i))
+		}
+		kept, err := d.Filter(file, items)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := collect(file, kept); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(context.Background(), collect); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seen) != 2000 {
+		t.Fatalf("got %d unique items, want 2000", len(seen))
+	}
+	for item, n := range seen {
+		if n != 1 {
+			t.Fatalf("%s emitted %d times", item, n)
+		}
+	}
+	stats := d.Stats()
+	if stats["a"] != (DedupeFileStats{Unique: 2000}) || stats["b"] != (DedupeFileStats{Duplicates: 2000}) {
+		t.Fatalf("stats = %+v", stats)
+	}
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 0 {
+		t.Fatalf("spill files left behind: %v", entries)
+	}
+	if _, err := d.Filter("c", []string{"x"}); err == nil {
+		t.Fatal("expected an error from Filter after Flush")
+	}
+}
+
+func TestDedupeRunDiscardsSpillsOnError(t *testing.T) {
+	tempDir := t.TempDir()
+	d := &Dedupe[string]{Key: identity, MemoryLimit: 1024, Partitions: 4, TempDir: tempDir}
+
+	chunkErr := errors.New("bad chunk")
+	in := make(chan ProcessedChunk[string], 2)
+	var items []string
+	for i := 0; i < 500; i++ {
+		items = append(items, fmt.Sprintf("item-%d", i))
+	}
+	in <- ProcessedChunk[string]{File: "a", Items: items}
+	in <- ProcessedChunk[string]{File: "a", ChunkIndex: 1, Err: chunkErr}
+	close(in)
+
+	emitted := 0
+	err := d.Run(context.Background(), in, func(_ string, items []string) error {
+		emitted += len(items)
+		return nil
+	})
+	if !errors.Is(err, chunkErr) {
+		t.Fatalf("expected %v, got %v", chunkErr, err)
+	}
+	if s := d.Stats()["a"]; s.Spilled == 0 || int64(emitted) != s.Unique {
+		t.Fatalf("stats %+v after emitting %d items, want spilled items left unread", s, emitted)
+	}
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 0 {
+		t.Fatalf("spill files left behind: %v", entries)
+	}
+}
@@ -0,0 +1,154 @@
+package iowrapper
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FailurePolicy decides how the pipeline reacts when a file fails.
+type FailurePolicy int
+
+const (
+	// FailFast cancels all remaining work on the first failure.
+	FailFast FailurePolicy = iota
+	// SkipFile abandons the failing file, keeps processing the others and reports the failures at the end.
+	SkipFile
+	// ContinueOnError keeps processing everything that can still be processed, including the rest of a
+	// file whose chunk failed to process, and reports the failures at the end.
+	ContinueOnError
+)
+
+func (p FailurePolicy) String() string {
+	switch p {
+	case FailFast:
+		return "fail-fast"
+	case SkipFile:
+		return "skip-file"
+	case ContinueOnError:
+		return "continue"
+	default:
+		return fmt.Sprintf("FailurePolicy(%d)", int(p))
+	}
+}
+
+// FileError records the failure of a single file.
+type FileError struct {
+	File string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.File, e.Err)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// PanicError is returned for a chunk whose processor panicked.
+type PanicError struct {
+	File       string
+	ChunkIndex int
+	Value      any
+	Stack      []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic processing %s chunk %d: %v\n%s", e.File, e.ChunkIndex, e.Value, e.Stack)
+}
+
+// Unwrap returns the panic value when it is an error.
+func (e *PanicError) Unwrap() error {
+	if err, ok := e.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// FailureReport lists every file failure observed during a run.
+type FailureReport struct {
+	Errors []*FileError
+}
+
+func (r *FailureReport) Error() string {
+	files := r.Files()
+	parts := make([]string, 0, len(r.Errors))
+	for _, e := range r.Errors {
+		parts = append(parts, e.Error())
+	}
+	return fmt.Sprintf("%d file(s) failed: %s", len(files), strings.Join(parts, "; "))
+}
+
+func (r *FailureReport) Unwrap() []error {
+	errs := make([]error, len(r.Errors))
+	for i, e := range r.Errors {
+		errs[i] = e
+	}
+	return errs
+}
+
+// Files returns the distinct failed files in the order their first failure was recorded.
+func (r *FailureReport) Files() []string {
+	seen := make(map[string]struct{}, len(r.Errors))
+	var files []string
+	for _, e := range r.Errors {
+		if _, ok := seen[e.File]; ok {
+			continue
+		}
+		seen[e.File] = struct{}{}
+		files = append(files, e.File)
+	}
+	return files
+}
+
+// CollectErrors drains errCh and returns a *FailureReport covering every *FileError received.
+// Errors that are not *FileError are reported under an empty file name. It returns nil when the
+// channel delivered no errors.
+func CollectErrors(errCh <-chan error) error {
+	var report FailureReport
+	for err := range errCh {
+		report.add(err)
+	}
+	if len(report.Errors) == 0 {
+		return nil
+	}
+	return &report
+}
+
+func (r *FailureReport) add(err error) {
+	if err == nil {
+		return
+	}
+	if fe, ok := err.(*FileError); ok {
+		r.Errors = append(r.Errors, fe)
+		return
+	}
+	r.Errors = append(r.Errors, &FileError{Err: err})
+}
+
+// relayErrors forwards everything received on in to out without ever blocking the sender and
+// without dropping errors. out is closed once in is closed and every error has been delivered. It
+// does not stop on cancellation, which would lose the errors of a run that is being wound down, so
+// it only returns once the receiver has drained out.
+func relayErrors(in <-chan error, out chan<- error) {
+	var queue []error
+	for in != nil || len(queue) > 0 {
+		var send chan<- error
+		var next error
+		if len(queue) > 0 {
+			send = out
+			next = queue[0]
+		}
+		select {
+		case err, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			queue = append(queue, err)
+		case send <- next:
+			queue = queue[1:]
+		}
+	}
+	close(out)
+}
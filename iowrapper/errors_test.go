@@ -0,0 +1,41 @@
+package iowrapper
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFailureReport(t *testing.T) {
+	errA := errors.New("boom")
+	errCh := make(chan error, 4)
+	errCh <- &FileError{File: "a.log", Err: errA}
+	errCh <- &FileError{File: "b.log", Err: errors.New("bad gzip header")}
+	errCh <- &FileError{File: "a.log", Err: errors.New("again")}
+	errCh <- errors.New("no file")
+	close(errCh)
+
+	err := CollectErrors(errCh)
+	var report *FailureReport
+	if !errors.As(err, &report) {
+		t.Fatalf("expected *FailureReport, got %T", err)
+	}
+	if got, want := report.Files(), []string{"a.log", "b.log", ""}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Files() = %v, want %v", got, want)
+	}
+	if !errors.Is(err, errA) {
+		t.Fatalf("expected report to wrap %v", errA)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "a.log: boom") || !strings.Contains(msg, "b.log: bad gzip header") {
+		t.Fatalf("unexpected report message %q", msg)
+	}
+}
+
+func TestCollectErrorsEmpty(t *testing.T) {
+	errCh := make(chan error)
+	close(errCh)
+	if err := CollectErrors(errCh); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+}
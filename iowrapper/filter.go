@@ -0,0 +1,323 @@
+package iowrapper
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// FieldFormat selects how Filter extracts fields from a line.
+type FieldFormat int
+
+const (
+	// FieldsAuto parses lines starting with '{' as JSON and everything else as logfmt.
+	FieldsAuto FieldFormat = iota
+	// FieldsLogfmt parses lines as logfmt: key=value pairs, with optionally double-quoted values.
+	FieldsLogfmt
+	// FieldsJSON parses lines as JSON objects. Nested fields are addressed with dotted names, e.g. "http.status".
+	FieldsJSON
+)
+
+// FieldPredicate tests a single field of a line. Lines without the field do not satisfy it.
+type FieldPredicate struct {
+	Field string
+	// Match receives the field's value. JSON strings are unquoted, other JSON values are passed as
+	// their JSON text.
+	Match func(value string) bool
+}
+
+// FieldEquals is satisfied when field equals value.
+func FieldEquals(field, value string) FieldPredicate {
+	return FieldPredicate{Field: field, Match: func(v string) bool { return v == value }}
+}
+
+// FieldMatches is satisfied when the value of field matches re.
+func FieldMatches(field string, re *regexp.Regexp) FieldPredicate {
+	return FieldPredicate{Field: field, Match: re.MatchString}
+}
+
+// FieldExists is satisfied when the line has field, whatever its value.
+func FieldExists(field string) FieldPredicate {
+	return FieldPredicate{Field: field, Match: func(string) bool { return true }}
+}
+
+// Filter selects lines, like grep across the chunks of a run. A line matches when it contains one of
+// Contains, matches one of Regexps and satisfies every predicate in Fields; unset conditions are
+// ignored. Use Processor to keep the matching lines as they are, or Filtered and FilterLines to run
+// another processor on them only.
+//
+// A Filter counts the lines it matched and rejected, so it must not be copied after first use and
+// should only serve one run at a time.
+type Filter struct {
+	// Contains lists fixed strings; a line must contain at least one of them.
+	Contains []string
+	// Regexps lists expressions; a line must match at least one of them.
+	Regexps []*regexp.Regexp
+	// Fields lists predicates on the fields of the line, which must all be satisfied.
+	Fields []FieldPredicate
+	// Format selects how fields are parsed. Defaults to FieldsAuto.
+	Format FieldFormat
+	// Invert keeps the lines that do not match instead.
+	Invert bool
+
+	once     sync.Once
+	contains [][]byte
+	matched  atomic.Int64
+	rejected atomic.Int64
+}
+
+// Match reports whether line matches the filter, taking Invert into account. It does not count the line.
+func (f *Filter) Match(line []byte) bool {
+	f.once.Do(func() {
+		for _, s := range f.Contains {
+			f.contains = append(f.contains, []byte(s))
+		}
+	})
+	return f.match(line) != f.Invert
+}
+
+func (f *Filter) match(line []byte) bool {
+	if len(f.contains) > 0 && !containsAny(line, f.contains) {
+		return false
+	}
+	if len(f.Regexps) > 0 {
+		found := false
+		for _, re := range f.Regexps {
+			if re.Match(line) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Fields) > 0 {
+		lookup := f.fieldLookup(line)
+		for _, pred := range f.Fields {
+			value, ok := lookup(pred.Field)
+			if !ok || !pred.Match(value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// count adds the lines of one chunk to the totals once the chunk has been processed. A failed chunk
+// is not counted, since a retry or a later run processes its lines again; line errors leave the
+// chunk's results in place and do not count as a failure.
+func (f *Filter) count(matched, rejected int64, err error) {
+	var le *LineErrors
+	if err != nil && !errors.As(err, &le) {
+		return
+	}
+	f.matched.Add(matched)
+	f.rejected.Add(rejected)
+}
+
+// Matched returns the number of lines kept by the chunks processed so far.
+func (f *Filter) Matched() int64 {
+	return f.matched.Load()
+}
+
+// Rejected returns the number of lines dropped by the chunks processed so far.
+func (f *Filter) Rejected() int64 {
+	return f.rejected.Load()
+}
+
+// Processor returns a ChunkProcessorFunc that passes on the matching lines, without their line endings.
+func (f *Filter) Processor() ChunkProcessorFunc[string] {
+	return FilterLines(f, func(line []byte, _ LinePos) (string, bool, error) {
+		return string(line), true, nil
+	})
+}
+
+// FilterLines returns a ChunkProcessorFunc that calls fn, like LineProcessor, for the lines matched
+// by f and drops the others. Line positions stay absolute within the file.
+func FilterLines[T any](f *Filter, fn LineFunc[T]) ChunkProcessorFunc[T] {
+	return func(chunk FileChunk) ([]T, error) {
+		var matched, rejected int64
+		items, err := LineProcessor(func(line []byte, pos LinePos) (T, bool, error) {
+			if !f.Match(line) {
+				rejected++
+				var zero T
+				return zero, false, nil
+			}
+			matched++
+			return fn(line, pos)
+		})(chunk)
+		f.count(matched, rejected, err)
+		return items, err
+	}
+}
+
+// Filtered returns a ChunkProcessorFunc that passes next a copy of each chunk holding only the lines
+// matched by f. The chunk keeps the Offset and FirstLine of the first matching line, but its lines are
+// no longer contiguous; use FilterLines with LineProcessor when next needs exact line positions.
+// Chunks without a matching line are not passed on.
+func Filtered[T any](f *Filter, next ChunkProcessorFunc[T]) ChunkProcessorFunc[T] {
+	return func(chunk FileChunk) ([]T, error) {
+		var kept []byte
+		var matched, rejected int64
+		offset, line := chunk.Offset, chunk.FirstLine
+		first := true
+		data := chunk.Chunk.Data
+		for len(data) > 0 {
+			end := len(data)
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				end = i + 1
+			}
+			if f.Match(bytes.TrimRight(data[:end], "\r\n")) {
+				matched++
+				if first {
+					chunk.Offset, chunk.FirstLine = offset, line
+					first = false
+				}
+				kept = append(kept, data[:end]...)
+			} else {
+				rejected++
+			}
+			offset += int64(end)
+			line++
+			data = data[end:]
+		}
+		if len(kept) == 0 {
+			f.count(0, rejected, nil)
+			return nil, nil
+		}
+		chunk.Chunk.Data = kept
+		items, err := next(chunk)
+		f.count(matched, rejected, err)
+		return items, err
+	}
+}
+
+func containsAny(line []byte, subs [][]byte) bool {
+	for _, sub := range subs {
+		if bytes.Contains(line, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldLookup returns a function looking up fields of line. A JSON line is decoded once, on the
+// first lookup.
+func (f *Filter) fieldLookup(line []byte) func(field string) (string, bool) {
+	format := f.Format
+	if format == FieldsAuto {
+		format = FieldsLogfmt
+		if trimmed := bytes.TrimLeft(line, " \t"); len(trimmed) > 0 && trimmed[0] == '{' {
+			format = FieldsJSON
+		}
+	}
+	if format == FieldsLogfmt {
+		return func(field string) (string, bool) {
+			return logfmtField(line, field)
+		}
+	}
+
+	var (
+		decoded bool
+		obj     map[string]json.RawMessage
+	)
+	return func(field string) (string, bool) {
+		if !decoded {
+			decoded = true
+			if json.Unmarshal(line, &obj) != nil {
+				obj = nil
+			}
+		}
+		return jsonField(obj, field)
+	}
+}
+
+// jsonField looks up a dotted field name in obj.
+func jsonField(obj map[string]json.RawMessage, field string) (string, bool) {
+	for obj != nil {
+		// Prefer a key containing the dots over descending into nested objects.
+		if raw, ok := obj[field]; ok {
+			var s string
+			if json.Unmarshal(raw, &s) == nil {
+				return s, true
+			}
+			return string(bytes.TrimSpace(raw)), true
+		}
+		head, rest, ok := strings.Cut(field, ".")
+		if !ok {
+			return "", false
+		}
+		var nested map[string]json.RawMessage
+		if json.Unmarshal(obj[head], &nested) != nil {
+			return "", false
+		}
+		obj, field = nested, rest
+	}
+	return "", false
+}
+
+// logfmtField returns the value of key in a logfmt line. A key without "=" has an empty value.
+func logfmtField(line []byte, key string) (string, bool) {
+	for len(line) > 0 {
+		line = bytes.TrimLeft(line, " \t")
+		if len(line) == 0 {
+			break
+		}
+		end := bytes.IndexAny(line, "= \t")
+		if end < 0 {
+			end = len(line)
+		}
+		k := line[:end]
+		line = line[end:]
+
+		var value []byte
+		quoted := false
+		if len(line) > 0 && line[0] == '=' {
+			line = line[1:]
+			if len(line) > 0 && line[0] == '"' {
+				value, line = scanQuoted(line)
+				quoted = true
+			} else {
+				end := bytes.IndexAny(line, " \t")
+				if end < 0 {
+					end = len(line)
+				}
+				value, line = line[:end], line[end:]
+			}
+		}
+		if string(k) == key {
+			if quoted {
+				return unquoteLogfmt(value), true
+			}
+			return string(value), true
+		}
+	}
+	return "", false
+}
+
+// scanQuoted splits a double-quoted value, including its quotes, from the rest of line.
+func scanQuoted(line []byte) ([]byte, []byte) {
+	for i := 1; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			return line[:i+1], line[i+1:]
+		}
+	}
+	return line, nil
+}
+
+func unquoteLogfmt(quoted []byte) string {
+	var s string
+	if json.Unmarshal(quoted, &s) == nil {
+		return s
+	}
+	// Not valid JSON escaping, or unterminated: strip the quotes and keep the rest as is.
+	return strings.TrimSuffix(strings.TrimPrefix(string(quoted), `"`), `"`)
+}
@@ -0,0 +1,148 @@
+package iowrapper
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterMatch(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		filter *Filter
+		line   string
+		want   bool
+	}{
+		{"contains", &Filter{Contains: []string{"foo", "bar"}}, "a bar b", true},
+		{"contains miss", &Filter{Contains: []string{"foo"}}, "a bar b", false},
+		{"regexp", &Filter{Regexps: []*regexp.Regexp{regexp.MustCompile(`\d{3}`)}}, "code 404", true},
+		{"regexp miss", &Filter{Regexps: []*regexp.Regexp{regexp.MustCompile(`\d{3}`)}}, "code 4", false},
+		{"contains and regexp", &Filter{Contains: []string{"GET"}, Regexps: []*regexp.Regexp{regexp.MustCompile(`5\d\d`)}}, "GET 404", false},
+		{"invert", &Filter{Contains: []string{"debug"}, Invert: true}, "level=info", true},
+		{"logfmt", &Filter{Fields: []FieldPredicate{FieldEquals("level", "error")}}, `ts=1 level=error msg="disk full"`, true},
+		{"logfmt quoted", &Filter{Fields: []FieldPredicate{FieldEquals("msg", `disk "sda" full`)}}, `level=error msg="disk \"sda\" full" id=3`, true},
+		{"logfmt missing", &Filter{Fields: []FieldPredicate{FieldExists("user")}}, `level=error msg=x`, false},
+		{"logfmt bare key", &Filter{Fields: []FieldPredicate{FieldExists("retry")}}, `level=warn retry msg=x`, true},
+		{"json", &Filter{Fields: []FieldPredicate{FieldEquals("level", "warn")}}, `{"level":"warn","n":1}`, true},
+		{"json number", &Filter{Fields: []FieldPredicate{FieldMatches("http.status", regexp.MustCompile(`^5`))}}, `{"http":{"status":503}}`, true},
+		{"json dotted key", &Filter{Fields: []FieldPredicate{FieldEquals("a.b", "x")}}, `{"a.b":"x"}`, true},
+		{"json all fields", &Filter{Fields: []FieldPredicate{FieldEquals("level", "warn"), FieldExists("user")}}, `{"level":"warn"}`, false},
+		{"json forced logfmt", &Filter{Format: FieldsLogfmt, Fields: []FieldPredicate{FieldExists("level")}}, `{"level":"warn"}`, false},
+		{"invalid json", &Filter{Format: FieldsJSON, Fields: []FieldPredicate{FieldExists("level")}}, `level=warn`, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.filter.Match([]byte(tc.line)); got != tc.want {
+				t.Fatalf("Match(%q) = %v, want %v", tc.line, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFilterProcessor(t *testing.T) {
+	_, files, cleanup := createFakeLogFiles(t, 2, 1000)
+	defer cleanup()
+
+	// Lines are "file=... index=N data=...": keep indexes ending in 7.
+	f := &Filter{Regexps: []*regexp.Regexp{regexp.MustCompile(`index=\d*7 `)}}
+	var got []string
+	p := &Pipeline[string]{
+		Sources:   files,
+		ChunkSize: 1024,
+		Processor: f.Processor(),
+		Sink: func(_ string, items []string) error {
+			got = append(got, items...)
+			return nil
+		},
+	}
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 200 || f.Matched() != 200 || f.Rejected() != 1800 {
+		t.Fatalf("got %d lines, matched %d, rejected %d", len(got), f.Matched(), f.Rejected())
+	}
+	for _, line := range got {
+		if !strings.Contains(line, "7 data=") || strings.HasSuffix(line, "\n") {
+			t.Fatalf("unexpected line %q", line)
+		}
+	}
+}
+
+func TestFiltered(t *testing.T) {
+	data := "a 1\nb 2\r\na 3\nb 4\na 5"
+	chunk := FileChunk{File: "f.log", Chunk: BytesChunk{Data: []byte(data)}, Offset: 100, FirstLine: 10}
+	f := &Filter{Contains: []string{"b"}}
+
+	var seen FileChunk
+	items, err := Filtered(f, func(c FileChunk) ([]string, error) {
+		seen = c
+		return strings.Fields(string(c.Chunk.Data)), nil
+	})(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b", "2", "b", "4"}; !reflect.DeepEqual(items, want) {
+		t.Fatalf("items = %v, want %v", items, want)
+	}
+	if seen.Offset != 104 || seen.FirstLine != 11 {
+		t.Fatalf("chunk positioned at offset %d line %d, want 104 and 11", seen.Offset, seen.FirstLine)
+	}
+	if f.Matched() != 2 || f.Rejected() != 3 {
+		t.Fatalf("matched %d, rejected %d", f.Matched(), f.Rejected())
+	}
+
+	called := false
+	items, err = Filtered(&Filter{Contains: []string{"zzz"}}, func(FileChunk) ([]string, error) {
+		called = true
+		return nil, nil
+	})(chunk)
+	if err != nil || items != nil || called {
+		t.Fatalf("expected no call for a chunk without matches")
+	}
+}
+
+func TestFilterLines(t *testing.T) {
+	f := &Filter{Fields: []FieldPredicate{FieldEquals("level", "error")}, Invert: true}
+	process := FilterLines(f, func(line []byte, pos LinePos) (int64, bool, error) {
+		return pos.Line, true, nil
+	})
+	items, err := process(FileChunk{Chunk: BytesChunk{Data: []byte("level=info\nlevel=error\nlevel=debug\n")}, FirstLine: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{1, 3}; !reflect.DeepEqual(items, want) {
+		t.Fatalf("items = %v, want %v", items, want)
+	}
+}
+
+func TestFilteredCountsRetriedChunksOnce(t *testing.T) {
+	chunk := FileChunk{File: "f.log", Chunk: BytesChunk{Data: []byte("a 1\nb 2\na 3\n")}}
+	f := &Filter{Contains: []string{"a"}}
+
+	attempts := 0
+	process := Filtered(f, func(c FileChunk) ([]string, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("transient")
+		}
+		return strings.Fields(string(c.Chunk.Data)), nil
+	})
+	policy := RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+	if _, err := retryChunk(context.Background(), policy, chunk, process); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 || f.Matched() != 2 || f.Rejected() != 1 {
+		t.Fatalf("after %d attempts: matched %d, rejected %d, want 2 and 1", attempts, f.Matched(), f.Rejected())
+	}
+
+	failing := Filtered(f, func(FileChunk) ([]string, error) { return nil, errors.New("permanent") })
+	if _, err := failing(chunk); err == nil {
+		t.Fatal("expected an error")
+	}
+	if f.Matched() != 2 || f.Rejected() != 1 {
+		t.Fatalf("a failed chunk was counted: matched %d, rejected %d", f.Matched(), f.Rejected())
+	}
+}
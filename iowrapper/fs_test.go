@@ -0,0 +1,222 @@
+package iowrapper
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func gzipBytes(t testing.TB, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstdBytes(t testing.TB, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadLinesFS(t *testing.T) {
+	const text = "alpha\nbeta\ngamma\n"
+	fsys := fstest.MapFS{
+		"plain.log":         {Data: []byte(text)},
+		"logs/suffix.gz":    {Data: gzipBytes(t, text)},
+		"logs/suffix.zst":   {Data: zstdBytes(t, text)},
+		"logs/magic-gz.bin": {Data: gzipBytes(t, text)},
+		"logs/magic-zstd":   {Data: zstdBytes(t, text)},
+	}
+	want := []string{"alpha", "beta", "gamma"}
+
+	for name := range fsys {
+		t.Run(name, func(t *testing.T) {
+			got, err := ReadLinesFS(fsys, name)
+			if err != nil {
+				t.Fatalf("ReadLinesFS: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+		})
+	}
+
+	if _, err := ReadLinesFS(fsys, "missing.log"); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
+
+func TestReaderDetectsMagic(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "rotated.log.1"), gzipBytes(t, "one\ntwo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, read := range map[string]func() ([]string, error){
+		"disk": func() ([]string, error) { return ReadLines(filepath.Join(dir, "rotated.log.1")) },
+		"fs":   func() ([]string, error) { return ReadLinesFS(os.DirFS(dir), "rotated.log.1") },
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"one", "two"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestOpenReaderAtFS(t *testing.T) {
+	const text = "0123456789abcdef\n"
+	fsys := fstest.MapFS{
+		"plain.log": {Data: []byte(text)},
+		"magic.log": {Data: gzipBytes(t, text)},
+	}
+	for _, tc := range []struct {
+		name   string
+		seeked bool
+	}{
+		{name: "plain.log", seeked: true},
+		{name: "magic.log", seeked: false},
+	} {
+		reader, closer, seeked, err := openReaderAt(fsys, tc.name, 64, 10, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		rest, err := io.ReadAll(reader)
+		closer.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rest) != "abcdef\n" || seeked != tc.seeked {
+			t.Fatalf("%s: read %q, seeked %v; want %q, seeked %v", tc.name, rest, seeked, "abcdef\n", tc.seeked)
+		}
+	}
+}
+
+func TestPipelineFS(t *testing.T) {
+	const linesPerFile = 2000
+
+	fsys := fstest.MapFS{}
+	var sources []string
+	for i := 0; i < 3; i++ {
+		base := fmt.Sprintf("file_%02d.log", i)
+		var b strings.Builder
+		for j := 0; j < linesPerFile; j++ {
+			fmt.Fprintf(&b, "file=%s index=%d data=%032d\n", base, j, j)
+		}
+		name := "logs/" + base
+		data := []byte(b.String())
+		switch i {
+		case 1:
+			name += ".gz"
+			data = gzipBytes(t, b.String())
+		case 2:
+			data = zstdBytes(t, b.String())
+		}
+		fsys[name] = &fstest.MapFile{Data: data}
+		sources = append(sources, name)
+	}
+
+	counts := make(map[string]int)
+	p := &Pipeline[FakeLogRecord]{
+		Sources:          sources,
+		FS:               fsys,
+		ReaderWorkers:    2,
+		ProcessorWorkers: 2,
+		ChunkSize:        4 * 1024,
+		Schedule:         LargestFirstFS(fsys),
+		Processor:        parseChunkToFakeLogRecords,
+		Sink: func(file string, items []FakeLogRecord) error {
+			for _, rec := range items {
+				if rec.Index != counts[file] {
+					return fmt.Errorf("%s: got record %d, want %d", file, rec.Index, counts[file])
+				}
+				counts[file]++
+			}
+			return nil
+		},
+	}
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	for _, name := range sources {
+		if counts[name] != linesPerFile {
+			t.Fatalf("%s: got %d records, want %d", name, counts[name], linesPerFile)
+		}
+	}
+}
+
+func TestStartChunkWorkersZipFS(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range map[string][]byte{
+		"a.log":    []byte("a1\na2\n"),
+		"b.log.gz": gzipBytes(t, "b1\nb2\nb3\n"),
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	files := StartFileProducer(ctx, []string{"a.log", "b.log.gz", "missing.log"})
+	chunks, errCh := StartChunkWorkersFS(ctx, zr, 1, 1024, files, WithFailurePolicy(ContinueOnError))
+	lines := make(map[string]int64)
+	for chunk := range chunks {
+		if chunk.Summary != nil && chunk.Summary.Err == nil {
+			lines[chunk.File] = chunk.Summary.Lines
+		}
+	}
+	err = CollectErrors(errCh)
+
+	if want := map[string]int64{"a.log": 2, "b.log.gz": 3}; !reflect.DeepEqual(lines, want) {
+		t.Fatalf("lines = %v, want %v", lines, want)
+	}
+	var report *FailureReport
+	if !errors.As(err, &report) || !reflect.DeepEqual(report.Files(), []string{"missing.log"}) {
+		t.Fatalf("expected a report for missing.log, got %v", err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"strings"
 
@@ -12,14 +13,21 @@ import (
 	"github.com/klauspost/compress/zstd"
 )
 
-type bytesChunkerFunc func(r io.Reader, chunkSize int, chunkCh chan<- BytesChunk)
+// SplitterFunc splits the contents of r into chunks of roughly chunkSize bytes and sends them to chunkCh
+// in order. Implementations must not close chunkCh. SliceToBytesChunks and SliceToBytesChunks2 are SplitterFuncs.
+type SplitterFunc func(r io.Reader, chunkSize int, chunkCh chan<- BytesChunk)
 
 // Scanner opens the source and returns a bufio.Scanner and an io.Closer.
 // Caller must defer closer.Close().
 func Scanner(source string) (*bufio.Scanner, io.Closer, error) {
-	r, closer, err := Reader(source, 64*1024)
+	return ScannerFS(nil, source)
+}
+
+// ScannerFS is Scanner reading name from fsys. A nil fsys reads from the operating system.
+func ScannerFS(fsys fs.FS, name string) (*bufio.Scanner, io.Closer, error) {
+	r, closer, err := ReaderFS(fsys, name, 64*1024)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to open source %s: %v", source, err)
+		return nil, nil, fmt.Errorf("failed to open source %s: %v", name, err)
 	}
 	scanner := bufio.NewScanner(r)
 	return scanner, closer, err
@@ -27,7 +35,65 @@ func Scanner(source string) (*bufio.Scanner, io.Closer, error) {
 
 // Reader opens the source and returns a bufio.Scanner and an io.Closer.
 // Caller must defer closer.Close().
+//
+// Sources ending in .gz, .zst or .zstd are decompressed, and so are files of any other name that
+// start with the gzip or zstd magic bytes. "-" reads from stdin, which is detected by suffix alone.
 func Reader(source string, size int) (*bufio.Reader, io.Closer, error) {
+	return openReader(nil, source, size, nil)
+}
+
+// ReaderFS is Reader reading name from fsys, e.g. an fstest.MapFS, an embed.FS or a zip.Reader.
+// Decompression works as with Reader. A nil fsys reads from the operating system.
+func ReaderFS(fsys fs.FS, name string, size int) (*bufio.Reader, io.Closer, error) {
+	return openReader(fsys, name, size, nil)
+}
+
+// compression identifies the decompressor applied to a source.
+type compression int
+
+const (
+	uncompressed compression = iota
+	gzipped
+	zstandard
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// detectCompression picks the decompressor from the suffix of source, falling back to the magic bytes
+// at the start of its data.
+func detectCompression(source string, header []byte) compression {
+	switch {
+	case strings.HasSuffix(source, ".gz"):
+		return gzipped
+	case strings.HasSuffix(source, ".zst") || strings.HasSuffix(source, ".zstd"):
+		return zstandard
+	case bytes.HasPrefix(header, gzipMagic):
+		return gzipped
+	case bytes.HasPrefix(header, zstdMagic):
+		return zstandard
+	}
+	return uncompressed
+}
+
+// sniffMagic reports whether the magic bytes of source take part in detecting its compression: for
+// every file, but not for stdin, which is never held up waiting for a header.
+func sniffMagic(source string) bool {
+	return source != "-"
+}
+
+// openFile opens source in fsys, or on the operating system when fsys is nil.
+func openFile(fsys fs.FS, source string) (fs.File, error) {
+	if fsys == nil {
+		return os.Open(source)
+	}
+	return fsys.Open(source)
+}
+
+// openReader is ReaderFS with an optional wrapper around the raw input, before decompression.
+func openReader(fsys fs.FS, source string, size int, wrap func(io.Reader) io.Reader) (*bufio.Reader, io.Closer, error) {
 	var r io.Reader
 	var closer io.Closer
 
@@ -35,45 +101,117 @@ func Reader(source string, size int) (*bufio.Reader, io.Closer, error) {
 		r = os.Stdin
 		closer = io.NopCloser(nil) // No need to close stdin, but return a no-op closer
 	} else {
-		file, err := os.Open(source)
+		file, err := openFile(fsys, source)
 		if err != nil {
 			return nil, nil, err
 		}
 		closer = file
 		r = file
-
-		// Handle compression
-		if strings.HasSuffix(source, ".gz") {
-			gr, err := gzip.NewReader(file)
-			if err != nil {
-				_ = file.Close()
-				return nil, nil, err
-			}
-			r = gr
-			closer = closerFunc(func() error {
-				gr.Close()
-				return file.Close()
-			})
-		} else if strings.HasSuffix(source, ".zst") || strings.HasSuffix(source, ".zstd") {
-			zr, err := zstd.NewReader(file)
-			if err != nil {
-				_ = file.Close()
-				return nil, nil, err
-			}
-			r = zr
-			closer = closerFunc(func() error {
-				zr.Close()
-				return file.Close()
-			})
-		}
+	}
+	if wrap != nil {
+		r = wrap(r)
 	}
 
 	reader := bufio.NewReaderSize(r, size)
+	var header []byte
+	if sniffMagic(source) {
+		// A short or failing peek leaves the header incomplete, which only disables magic detection;
+		// the error surfaces again on the first read.
+		header, _ = reader.Peek(len(zstdMagic))
+	}
+
+	// Handle compression
+	switch detectCompression(source, header) {
+	case gzipped:
+		gr, err := gzip.NewReader(reader)
+		if err != nil {
+			_ = closer.Close()
+			return nil, nil, err
+		}
+		file := closer
+		closer = closerFunc(func() error {
+			gr.Close()
+			return file.Close()
+		})
+		reader = bufio.NewReaderSize(gr, size)
+	case zstandard:
+		zr, err := zstd.NewReader(reader)
+		if err != nil {
+			_ = closer.Close()
+			return nil, nil, err
+		}
+		file := closer
+		closer = closerFunc(func() error {
+			zr.Close()
+			return file.Close()
+		})
+		reader = bufio.NewReaderSize(zr, size)
+	}
 	return reader, closer, nil
 }
 
+// Writer creates dest and returns a buffered writer that compresses according to the suffix of dest
+// (.gz, .zst or .zstd); "-" writes to stdout. The closer flushes the buffer, finishes the compressed
+// stream and closes the file, so its error must be checked.
+func Writer(dest string, size int) (*bufio.Writer, io.Closer, error) {
+	if dest == "-" {
+		w := bufio.NewWriterSize(os.Stdout, size)
+		return w, closerFunc(w.Flush), nil
+	}
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return nil, nil, err
+	}
+	return compressWriter(file, detectCompression(dest, nil), size)
+}
+
+// compressWriter is Writer for an open file and an explicit compression. The closer also closes file.
+func compressWriter(file io.WriteCloser, c compression, size int) (*bufio.Writer, io.Closer, error) {
+	var (
+		w      io.Writer = file
+		finish           = func() error { return nil }
+	)
+	switch c {
+	case gzipped:
+		gw := gzip.NewWriter(file)
+		w, finish = gw, gw.Close
+	case zstandard:
+		// An empty stream still gets a frame, as zstd rejects a 0-byte file.
+		zw, err := zstd.NewWriter(file, zstd.WithZeroFrames(true))
+		if err != nil {
+			_ = file.Close()
+			return nil, nil, err
+		}
+		w, finish = zw, zw.Close
+	}
+
+	bw := bufio.NewWriterSize(w, size)
+	closer := closerFunc(func() error {
+		err := bw.Flush()
+		if ferr := finish(); err == nil {
+			err = ferr
+		}
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+	return bw, closer, nil
+}
+
+// isCompressed reports whether the suffix of source selects a compression.
+func isCompressed(source string) bool {
+	return strings.HasSuffix(source, ".gz") || strings.HasSuffix(source, ".zst") || strings.HasSuffix(source, ".zstd")
+}
+
 func ReadLines(source string) ([]string, error) {
-	scanner, closer, err := Scanner(source)
+	return ReadLinesFS(nil, source)
+}
+
+// ReadLinesFS is ReadLines reading name from fsys. A nil fsys reads from the operating system.
+func ReadLinesFS(fsys fs.FS, name string) ([]string, error) {
+	scanner, closer, err := ScannerFS(fsys, name)
 	if err != nil {
 		return nil, err
 	}
@@ -218,10 +356,15 @@ func SliceToBytesChunks2(r io.Reader, chunkSize int, chunkCh chan<- BytesChunk)
 	if chunkSize <= 0 {
 		return
 	}
+	splitAtNewlines(r, func() int { return chunkSize }, chunkCh)
+}
 
+// splitAtNewlines implements SliceToBytesChunks2 with a chunk size that is looked up before every
+// chunk, so that it can change while a file is being split.
+func splitAtNewlines(r io.Reader, chunkSize func() int, chunkCh chan<- BytesChunk) {
 	reader := bufio.NewReader(r)
-	buffer := make([]byte, chunkSize)
 	var (
+		buffer   []byte
 		index    int
 		overflow []byte
 	)
@@ -237,10 +380,14 @@ func SliceToBytesChunks2(r io.Reader, chunkSize int, chunkCh chan<- BytesChunk)
 	}
 
 	for {
+		size := max(chunkSize(), 1)
+		if want := max(size, len(overflow)); len(buffer) != want {
+			buffer = make([]byte, want)
+		}
 		n := copy(buffer, overflow)
 		overflow = overflow[:0]
 
-		for n < chunkSize {
+		for n < size {
 			readN, err := reader.Read(buffer[n:])
 			n += readN
 
@@ -260,7 +407,7 @@ func SliceToBytesChunks2(r io.Reader, chunkSize int, chunkCh chan<- BytesChunk)
 			}
 		}
 
-		// We have at least chunkSize bytes in buffer. Extend to newline if possible.
+		// We have at least size bytes in buffer. Extend to newline if possible.
 		data := buffer[:n]
 		if idx := bytes.LastIndexByte(data, '\n'); idx != -1 {
 			// Keep everything after newline for next chunk.
@@ -1,11 +1,14 @@
 package iowrapper
 
 import (
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
 
-func collectChunks(t testing.TB, fn bytesChunkerFunc, input string, chunkSize int) []BytesChunk {
+func collectChunks(t testing.TB, fn SplitterFunc, input string, chunkSize int) []BytesChunk {
 	t.Helper()
 
 	r := strings.NewReader(input)
@@ -26,7 +29,7 @@ func collectChunks(t testing.TB, fn bytesChunkerFunc, input string, chunkSize in
 func TestSliceToBytesChunksVariants(t *testing.T) {
 	chunkers := []struct {
 		name string
-		fn   bytesChunkerFunc
+		fn   SplitterFunc
 	}{
 		{name: "LineReader", fn: SliceToBytesChunks},
 		{name: "Buffered", fn: SliceToBytesChunks2},
@@ -96,7 +99,7 @@ func TestSliceToBytesChunksVariants(t *testing.T) {
 	}
 }
 
-func benchmarkChunker(b *testing.B, fn bytesChunkerFunc) {
+func benchmarkChunker(b *testing.B, fn SplitterFunc) {
 	line := strings.Repeat("x", 1000) + "\n"
 	input := strings.Repeat(line, 1_000_000) // ~1 GB of data
 	chunkSize := 4 * 1024 * 1024
@@ -125,3 +128,60 @@ func BenchmarkSliceToBytesChunks(b *testing.B) {
 func BenchmarkSliceToBytesChunks2(b *testing.B) {
 	benchmarkChunker(b, SliceToBytesChunks2)
 }
+
+func TestWriterRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	lines := []string{"alpha", "beta", "gamma"}
+
+	for _, name := range []string{"plain.txt", "lines.gz", "lines.zst", "lines.zstd"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			w, closer, err := Writer(path, 16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range lines {
+				if _, err := w.WriteString(line + "\n"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := closer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ReadLines(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, lines) {
+				t.Fatalf("ReadLines = %v, want %v", got, lines)
+			}
+		})
+	}
+}
+
+func TestWriterEmptyZstdHasFrame(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.zst")
+	_, closer, err := Writer(path, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() == 0 {
+		t.Fatal("expected an empty zstd frame, got a 0-byte file")
+	}
+	got, err := ReadLines(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("ReadLines = %v, want none", got)
+	}
+}
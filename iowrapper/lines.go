@@ -0,0 +1,99 @@
+package iowrapper
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// LinePos locates a line within its file.
+type LinePos struct {
+	File string
+	// Line is the 1-based line number in the file.
+	Line int64
+	// Offset is the byte offset of the line's first byte in the file after decompression.
+	Offset int64
+}
+
+func (p LinePos) String() string {
+	return fmt.Sprintf("%s:%d", p.File, p.Line)
+}
+
+// LineFunc converts a single line, without its line ending, into an item. It returns false to drop the
+// line. An error only affects the line it was returned for.
+type LineFunc[T any] func(line []byte, pos LinePos) (T, bool, error)
+
+// LineError is the failure of a single line.
+type LineError struct {
+	Pos LinePos
+	Err error
+}
+
+func (e LineError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Pos, e.Err)
+}
+
+// LineErrors is returned by LineProcessor when some lines of a chunk failed. It is not a chunk
+// failure: StartChunkProcessors keeps the chunk's items and attaches the errors to the
+// ProcessedChunk, and the ordered collector reports them through FileHooks.OnLineErrors.
+type LineErrors struct {
+	Errors []LineError
+}
+
+func (e *LineErrors) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, le := range e.Errors {
+		msgs = append(msgs, le.Error())
+	}
+	return fmt.Sprintf("%d line(s) failed: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+func (e *LineErrors) list() []LineError {
+	if e == nil {
+		return nil
+	}
+	return e.Errors
+}
+
+// LineProcessor adapts fn into a ChunkProcessorFunc that calls fn for every line of the chunk.
+// Line numbers and offsets are absolute within the file. The line slice is only valid during the call.
+func LineProcessor[T any](fn LineFunc[T]) ChunkProcessorFunc[T] {
+	return func(chunk FileChunk) ([]T, error) {
+		var (
+			items []T
+			errs  []LineError
+		)
+		pos := LinePos{File: chunk.File, Line: chunk.FirstLine, Offset: chunk.Offset}
+		if pos.Line == 0 {
+			pos.Line = 1
+		}
+
+		data := chunk.Chunk.Data
+		for len(data) > 0 {
+			n := bytes.IndexByte(data, '\n')
+			var line []byte
+			if n < 0 {
+				line, data = data, nil
+				n = len(line) - 1
+			} else {
+				line, data = data[:n], data[n+1:]
+			}
+			line = bytes.TrimSuffix(line, []byte{'\r'})
+
+			item, keep, err := fn(line, pos)
+			if err != nil {
+				errs = append(errs, LineError{Pos: pos, Err: err})
+			} else if keep {
+				items = append(items, item)
+			}
+
+			pos.Line++
+			pos.Offset += int64(n + 1)
+		}
+
+		if len(errs) > 0 {
+			return items, &LineErrors{Errors: errs}
+		}
+		return items, nil
+	}
+}
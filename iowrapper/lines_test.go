@@ -0,0 +1,107 @@
+package iowrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLineProcessor(t *testing.T) {
+	bad := errors.New("bad line")
+	proc := LineProcessor(func(line []byte, pos LinePos) (string, bool, error) {
+		switch string(line) {
+		case "bad":
+			return "", false, bad
+		case "":
+			return "", false, nil
+		}
+		return fmt.Sprintf("%s@%d/%d", line, pos.Line, pos.Offset), true, nil
+	})
+
+	chunk := FileChunk{
+		File:      "a.log",
+		Chunk:     BytesChunk{Index: 3, Data: []byte("one\nbad\r\n\nlast")},
+		Offset:    100,
+		FirstLine: 10,
+	}
+	items, err := proc(chunk)
+
+	if want := []string{"one@10/100", "last@13/110"}; !reflect.DeepEqual(items, want) {
+		t.Fatalf("items = %v, want %v", items, want)
+	}
+	var lineErrs *LineErrors
+	if !errors.As(err, &lineErrs) || len(lineErrs.Errors) != 1 {
+		t.Fatalf("expected one line error, got %v", err)
+	}
+	le := lineErrs.Errors[0]
+	if le.Pos != (LinePos{File: "a.log", Line: 11, Offset: 104}) || !errors.Is(le.Err, bad) {
+		t.Fatalf("unexpected line error %+v", le)
+	}
+}
+
+func TestPipelineLineProcessorReportsLineErrors(t *testing.T) {
+	const linesPerFile = 3000
+
+	_, files, cleanup := createFakeLogFiles(t, 2, linesPerFile)
+	defer cleanup()
+
+	// Every line carries its 0-based index; fail every 500th line.
+	proc := LineProcessor(func(line []byte, pos LinePos) (int, bool, error) {
+		fields := strings.Fields(string(line))
+		idx, err := strconv.Atoi(strings.TrimPrefix(fields[1], "index="))
+		if err != nil {
+			return 0, false, err
+		}
+		if int64(idx+1) != pos.Line {
+			return 0, false, fmt.Errorf("index %d reported at line %d", idx, pos.Line)
+		}
+		if idx%500 == 0 {
+			return 0, false, errors.New("unlucky line")
+		}
+		return idx, true, nil
+	})
+
+	items := make(map[string]int)
+	lineErrs := make(map[string][]LineError)
+	stats := make(map[string]FileStats)
+	p := &Pipeline[int]{
+		Sources:          files,
+		ReaderWorkers:    2,
+		ProcessorWorkers: 4,
+		ChunkSize:        4 * 1024,
+		Processor:        proc,
+		Sink: func(file string, got []int) error {
+			items[file] += len(got)
+			return nil
+		},
+		Hooks: FileHooks{
+			OnLineErrors: func(file string, errs []LineError) {
+				lineErrs[file] = append(lineErrs[file], errs...)
+			},
+			OnComplete: func(s FileStats) { stats[s.File] = s },
+		},
+	}
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	const failing = linesPerFile / 500
+	for _, path := range files {
+		if items[path] != linesPerFile-failing {
+			t.Fatalf("file %s: expected %d items, got %d", path, linesPerFile-failing, items[path])
+		}
+		errs := lineErrs[path]
+		if len(errs) != failing || stats[path].LineErrors != failing {
+			t.Fatalf("file %s: expected %d line errors, got %d (stats %d)", path, failing, len(errs), stats[path].LineErrors)
+		}
+		for i, le := range errs {
+			if want := int64(i*500 + 1); le.Pos.Line != want || le.Pos.File != path {
+				t.Fatalf("line error %d at %v, want line %d", i, le.Pos, want)
+			}
+		}
+	}
+}
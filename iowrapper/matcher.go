@@ -0,0 +1,319 @@
+package iowrapper
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/mihudec/goutils/common"
+)
+
+// MatcherOptions configures a Matcher.
+type MatcherOptions struct {
+	// CaseInsensitive matches ASCII letters regardless of case.
+	CaseInsensitive bool
+	// WholeWords only reports matches that are neither preceded nor followed by a letter, digit or
+	// underscore, so that "evil.com" does not match inside "notevil.com".
+	WholeWords bool
+}
+
+// Matcher finds many fixed patterns in a single pass over the input, using the Aho-Corasick
+// algorithm, so the cost of a scan hardly depends on the number of patterns. It is safe for
+// concurrent use.
+type Matcher struct {
+	opts     MatcherOptions
+	patterns []string
+
+	// The trie, one entry per node; node 0 is the root. Children of a node are a linked list
+	// through sibling, except for the root's, which are looked up in root.
+	label   []byte
+	child   []int32
+	sibling []int32
+	fail    []int32
+	// pattern is the index of the pattern ending at the node, or -1; output is the nearest node
+	// on the fail chain where a pattern ends, or 0.
+	pattern []int32
+	output  []int32
+	root    [256]int32
+}
+
+// MatchSpan locates a match of Matcher.Patterns()[Pattern] at text[Start:End].
+type MatchSpan struct {
+	Pattern    int
+	Start, End int
+}
+
+// PatternMatch is a match found by Matcher.Processor.
+type PatternMatch struct {
+	File string
+	// Line is the 1-based number of the line the match is on.
+	Line int64
+	// Offset is the position of the match in the file after decompression.
+	Offset int64
+	// Pattern is the index of the pattern in the list passed to NewMatcher and Text the matched text.
+	Pattern int
+	Text    string
+}
+
+// NewMatcher builds a Matcher for patterns. Patterns must not be empty or contain a newline; a pattern
+// listed more than once is reported under its first index.
+func NewMatcher(patterns []string, opts MatcherOptions) (*Matcher, error) {
+	m := &Matcher{opts: opts, patterns: patterns}
+	m.addNode(0)
+	for i, p := range patterns {
+		if p == "" || strings.ContainsAny(p, "\r\n") {
+			return nil, fmt.Errorf("iowrapper: invalid pattern %d %q", i, p)
+		}
+		m.insert(p, int32(i))
+	}
+	m.link()
+	return m, nil
+}
+
+// Patterns returns the patterns the Matcher was built with.
+func (m *Matcher) Patterns() []string {
+	return m.patterns
+}
+
+func (m *Matcher) addNode(label byte) int32 {
+	m.label = append(m.label, label)
+	m.child = append(m.child, 0)
+	m.sibling = append(m.sibling, 0)
+	m.fail = append(m.fail, 0)
+	m.pattern = append(m.pattern, -1)
+	m.output = append(m.output, 0)
+	return int32(len(m.label) - 1)
+}
+
+func (m *Matcher) findChild(node int32, c byte) int32 {
+	if node == 0 {
+		return m.root[c]
+	}
+	for n := m.child[node]; n != 0; n = m.sibling[n] {
+		if m.label[n] == c {
+			return n
+		}
+	}
+	return 0
+}
+
+func (m *Matcher) insert(p string, index int32) {
+	node := int32(0)
+	for i := 0; i < len(p); i++ {
+		c := m.fold(p[i])
+		next := m.findChild(node, c)
+		if next == 0 {
+			next = m.addNode(c)
+			m.sibling[next] = m.child[node]
+			m.child[node] = next
+			if node == 0 {
+				m.root[c] = next
+			}
+		}
+		node = next
+	}
+	if m.pattern[node] < 0 {
+		m.pattern[node] = index
+	}
+}
+
+// link computes the fail and output links breadth first, so that the links of shallower nodes are
+// known when they are needed.
+func (m *Matcher) link() {
+	queue := make([]int32, 0, len(m.label))
+	for n := m.child[0]; n != 0; n = m.sibling[n] {
+		queue = append(queue, n)
+	}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for n := m.child[node]; n != 0; n = m.sibling[n] {
+			m.fail[n] = m.step(m.fail[node], m.label[n])
+			if f := m.fail[n]; m.pattern[f] >= 0 {
+				m.output[n] = f
+			} else {
+				m.output[n] = m.output[f]
+			}
+			queue = append(queue, n)
+		}
+	}
+}
+
+// step follows the transition for c from node, falling back along the fail links.
+func (m *Matcher) step(node int32, c byte) int32 {
+	for node != 0 {
+		if next := m.findChild(node, c); next != 0 {
+			return next
+		}
+		node = m.fail[node]
+	}
+	return m.root[c]
+}
+
+func (m *Matcher) fold(c byte) byte {
+	if m.opts.CaseInsensitive && 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// scan calls emit for every match in text, in order of their end.
+func (m *Matcher) scan(text []byte, emit func(pattern, start, end int)) {
+	node := int32(0)
+	for i := 0; i < len(text); i++ {
+		node = m.step(node, m.fold(text[i]))
+		for n := node; n != 0; n = m.output[n] {
+			p := m.pattern[n]
+			if p < 0 {
+				continue
+			}
+			start, end := i+1-len(m.patterns[p]), i+1
+			if m.opts.WholeWords && (start > 0 && isWordByte(text[start-1]) || end < len(text) && isWordByte(text[end])) {
+				continue
+			}
+			emit(int(p), start, end)
+		}
+	}
+}
+
+func isWordByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_'
+}
+
+// FindAll returns every match in text, overlapping ones included, in order of their end.
+func (m *Matcher) FindAll(text []byte) []MatchSpan {
+	var spans []MatchSpan
+	m.scan(text, func(pattern, start, end int) {
+		spans = append(spans, MatchSpan{Pattern: pattern, Start: start, End: end})
+	})
+	return spans
+}
+
+// Processor returns a ChunkProcessorFunc that reports every match in the chunk with its position in
+// the file.
+func (m *Matcher) Processor() ChunkProcessorFunc[PatternMatch] {
+	return func(chunk FileChunk) ([]PatternMatch, error) {
+		data := chunk.Chunk.Data
+		var matches []PatternMatch
+		// Patterns contain no newline, so matches never span lines and arrive in line order.
+		line := chunk.FirstLine
+		if line == 0 {
+			line = 1
+		}
+		eol := bytes.IndexByte(data, '\n')
+		m.scan(data, func(pattern, start, end int) {
+			for eol >= 0 && eol < start {
+				line++
+				next := bytes.IndexByte(data[eol+1:], '\n')
+				if next < 0 {
+					eol = -1
+				} else {
+					eol += next + 1
+				}
+			}
+			matches = append(matches, PatternMatch{
+				File:    chunk.File,
+				Line:    line,
+				Offset:  chunk.Offset + int64(start),
+				Pattern: pattern,
+				Text:    string(data[start:end]),
+			})
+		})
+		return matches, nil
+	}
+}
+
+// IndicatorKind classifies an indicator of compromise.
+type IndicatorKind int
+
+const (
+	IndicatorDomain IndicatorKind = iota + 1
+	IndicatorIPv4
+	IndicatorIPv6
+	IndicatorSHA1
+	IndicatorSHA256
+	IndicatorSHA512
+)
+
+func (k IndicatorKind) String() string {
+	switch k {
+	case IndicatorDomain:
+		return "domain"
+	case IndicatorIPv4:
+		return "ipv4"
+	case IndicatorIPv6:
+		return "ipv6"
+	case IndicatorSHA1:
+		return "sha1"
+	case IndicatorSHA256:
+		return "sha256"
+	case IndicatorSHA512:
+		return "sha512"
+	default:
+		return fmt.Sprintf("IndicatorKind(%d)", int(k))
+	}
+}
+
+// Indicator is a validated indicator of compromise.
+type Indicator struct {
+	Value string
+	Kind  IndicatorKind
+}
+
+// ParseIndicators validates values with the common package validators and returns the valid ones,
+// without duplicates, and the invalid ones. Domains, IPv6 addresses and hashes are lowercased, so
+// build the Matcher with CaseInsensitive. Blank values and values starting with "#" are ignored.
+func ParseIndicators(values []string) (valid []Indicator, invalid []string) {
+	seen := make(map[string]struct{}, len(values))
+	for _, raw := range values {
+		value := strings.TrimSpace(raw)
+		if value == "" || strings.HasPrefix(value, "#") {
+			continue
+		}
+		lower := strings.ToLower(value)
+		var ind Indicator
+		switch {
+		case common.IsValidIPv4(value):
+			ind = Indicator{Value: value, Kind: IndicatorIPv4}
+		case common.IsValidIPv6(value):
+			ind = Indicator{Value: lower, Kind: IndicatorIPv6}
+		case common.IsValidSHA1(value):
+			ind = Indicator{Value: lower, Kind: IndicatorSHA1}
+		case common.IsValidSHA256(value):
+			ind = Indicator{Value: lower, Kind: IndicatorSHA256}
+		case common.IsValidSHA512(value):
+			ind = Indicator{Value: lower, Kind: IndicatorSHA512}
+		case common.IsValidDomain(lower):
+			ind = Indicator{Value: lower, Kind: IndicatorDomain}
+		default:
+			invalid = append(invalid, raw)
+			continue
+		}
+		if _, dup := seen[ind.Value]; !dup {
+			seen[ind.Value] = struct{}{}
+			valid = append(valid, ind)
+		}
+	}
+	return valid, invalid
+}
+
+// LoadIndicators reads one indicator per line from source, which may be compressed, and validates
+// them with ParseIndicators.
+func LoadIndicators(source string) ([]Indicator, []string, error) {
+	lines, err := ReadLines(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	valid, invalid := ParseIndicators(lines)
+	return valid, invalid, nil
+}
+
+// NewIndicatorMatcher builds a case-insensitive Matcher for indicators; a PatternMatch's Pattern is the
+// index of the indicator found. wholeWords sets MatcherOptions.WholeWords.
+func NewIndicatorMatcher(indicators []Indicator, wholeWords bool) (*Matcher, error) {
+	patterns := make([]string, len(indicators))
+	for i, ind := range indicators {
+		patterns[i] = ind.Value
+	}
+	return NewMatcher(patterns, MatcherOptions{CaseInsensitive: true, WholeWords: wholeWords})
+}
@@ -0,0 +1,194 @@
+package iowrapper
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// bruteForceMatches finds the matches FindAll should report, ordered like FindAll.
+func bruteForceMatches(patterns []string, text string) []MatchSpan {
+	var spans []MatchSpan
+	for end := 1; end <= len(text); end++ {
+		var atEnd []MatchSpan
+		seen := make(map[string]bool)
+		for i, p := range patterns {
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+			if strings.HasSuffix(text[:end], p) {
+				atEnd = append(atEnd, MatchSpan{Pattern: i, Start: end - len(p), End: end})
+			}
+		}
+		// Longest first, as the output links go from the longest suffix to shorter ones.
+		slices.SortFunc(atEnd, func(a, b MatchSpan) int { return a.Start - b.Start })
+		spans = append(spans, atEnd...)
+	}
+	return spans
+}
+
+func TestMatcherAgainstBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randString := func(n int) string {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = "abc"[rng.Intn(3)]
+		}
+		return string(b)
+	}
+	for round := 0; round < 200; round++ {
+		patterns := make([]string, 1+rng.Intn(8))
+		for i := range patterns {
+			patterns[i] = randString(1 + rng.Intn(4))
+		}
+		text := randString(rng.Intn(60))
+		m, err := NewMatcher(patterns, MatcherOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := m.FindAll([]byte(text))
+		if want := bruteForceMatches(patterns, text); !reflect.DeepEqual(got, want) {
+			t.Fatalf("patterns %q in %q:\ngot  %v\nwant %v", patterns, text, got, want)
+		}
+	}
+}
+
+func TestMatcherOptions(t *testing.T) {
+	patterns := []string{"evil.com", "Bad"}
+	text := []byte("x.EVIL.com notevil.com bad_ BAD.")
+
+	m, err := NewMatcher(patterns, MatcherOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.FindAll(text); len(got) != 1 || string(text[got[0].Start:got[0].End]) != "evil.com" {
+		t.Fatalf("case-sensitive matches: %v", got)
+	}
+
+	m, err = NewMatcher(patterns, MatcherOptions{CaseInsensitive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.FindAll(text); len(got) != 4 {
+		t.Fatalf("case-insensitive matches: %v", got)
+	}
+
+	m, err = NewMatcher(patterns, MatcherOptions{CaseInsensitive: true, WholeWords: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, span := range m.FindAll(text) {
+		got = append(got, string(text[span.Start:span.End]))
+	}
+	if want := []string{"EVIL.com", "BAD"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("whole-word matches: %v, want %v", got, want)
+	}
+
+	if _, err := NewMatcher([]string{"ok", ""}, MatcherOptions{}); err == nil {
+		t.Fatal("expected an error for an empty pattern")
+	}
+	if _, err := NewMatcher([]string{"a\nb"}, MatcherOptions{}); err == nil {
+		t.Fatal("expected an error for a pattern with a newline")
+	}
+}
+
+func TestMatcherProcessor(t *testing.T) {
+	m, err := NewMatcher([]string{"foo", "bar"}, MatcherOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := FileChunk{
+		File:      "a.log",
+		Chunk:     BytesChunk{Data: []byte("foo\nnone\n\nxbar foo\n")},
+		Offset:    1000,
+		FirstLine: 50,
+	}
+	got, err := m.Processor()(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PatternMatch{
+		{File: "a.log", Line: 50, Offset: 1000, Pattern: 0, Text: "foo"},
+		{File: "a.log", Line: 53, Offset: 1011, Pattern: 1, Text: "bar"},
+		{File: "a.log", Line: 53, Offset: 1015, Pattern: 0, Text: "foo"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestParseIndicators(t *testing.T) {
+	sha1 := strings.Repeat("a", 40)
+	valid, invalid := ParseIndicators([]string{
+		"# feed", "", "Evil.COM", "evil.com", "10.0.0.1", "2001:DB8::1",
+		strings.ToUpper(sha1), strings.Repeat("b", 64), strings.Repeat("c", 128), "not a domain", "localhost",
+	})
+	want := []Indicator{
+		{"evil.com", IndicatorDomain},
+		{"10.0.0.1", IndicatorIPv4},
+		{"2001:db8::1", IndicatorIPv6},
+		{sha1, IndicatorSHA1},
+		{strings.Repeat("b", 64), IndicatorSHA256},
+		{strings.Repeat("c", 128), IndicatorSHA512},
+	}
+	if !reflect.DeepEqual(valid, want) {
+		t.Fatalf("valid = %v\nwant %v", valid, want)
+	}
+	if !reflect.DeepEqual(invalid, []string{"not a domain", "localhost"}) {
+		t.Fatalf("invalid = %v", invalid)
+	}
+}
+
+func TestIndicatorSweep(t *testing.T) {
+	dir := t.TempDir()
+	feed := filepath.Join(dir, "iocs.txt")
+	if err := os.WriteFile(feed, []byte("evil.com\n10.0.0.1\nnot valid\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	logFile := filepath.Join(dir, "access.log.gz")
+	logData := "GET http://www.EVIL.com/ from 10.0.0.12\nGET / from 10.0.0.1\nnotevil.com\n"
+	if err := os.WriteFile(logFile, gzipBytes(t, logData), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	indicators, invalid, err := LoadIndicators(feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invalid) != 1 {
+		t.Fatalf("invalid = %v", invalid)
+	}
+	m, err := NewIndicatorMatcher(indicators, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found []string
+	p := &Pipeline[PatternMatch]{
+		Sources:   []string{logFile},
+		Processor: m.Processor(),
+		Sink: func(_ string, items []PatternMatch) error {
+			for _, match := range items {
+				ind := indicators[match.Pattern]
+				if logData[match.Offset:match.Offset+int64(len(match.Text))] != match.Text {
+					t.Errorf("offset %d does not point at %q", match.Offset, match.Text)
+				}
+				found = append(found, ind.Kind.String()+":"+match.Text)
+			}
+			return nil
+		},
+	}
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"domain:EVIL.com", "ipv4:10.0.0.1"}; !reflect.DeepEqual(found, want) {
+		t.Fatalf("found %v, want %v", found, want)
+	}
+}
@@ -0,0 +1,329 @@
+package iowrapper
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Histogram buckets used by Metrics.
+var (
+	durationBuckets   = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+	chunkBytesBuckets = []float64{1 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+	chunkLinesBuckets = []float64{1, 10, 100, 1000, 10000, 100000, 1000000}
+)
+
+// Metrics instruments the pipeline stages. Pass the same Metrics to StartChunkWorkers,
+// StartChunkProcessors and the ordered collector with WithMetrics, or set Pipeline.Metrics, then read
+// it with Stats or WritePrometheus while the run is in progress. All methods are safe for concurrent
+// use, and a nil *Metrics records nothing.
+//
+// Comparing the read and process latencies, and which queue the chunks pile up in, tells whether a
+// run is bound by reading and decompression or by processing.
+type Metrics struct {
+	filesRead       atomic.Int64
+	chunksRead      atomic.Int64
+	bytesRead       atomic.Int64
+	linesRead       atomic.Int64
+	chunksProcessed atomic.Int64
+	chunkErrors     atomic.Int64
+	itemsEmitted    atomic.Int64
+	filesCompleted  atomic.Int64
+
+	inFlight      atomic.Int64
+	chunkQueue    atomic.Int64
+	resultQueue   atomic.Int64
+	reorderChunks atomic.Int64
+	reorderBytes  atomic.Int64
+	reorderPeak   atomic.Int64
+
+	readLatency    *histogram
+	processLatency *histogram
+	chunkBytes     *histogram
+	chunkLines     *histogram
+}
+
+// NewMetrics returns Metrics with histograms. The zero Metrics records no histograms.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		readLatency:    newHistogram(durationBuckets),
+		processLatency: newHistogram(durationBuckets),
+		chunkBytes:     newHistogram(chunkBytesBuckets),
+		chunkLines:     newHistogram(chunkLinesBuckets),
+	}
+}
+
+// Stats is a point-in-time copy of Metrics.
+type Stats struct {
+	// FilesRead, ChunksRead, BytesRead and LinesRead count what the chunk workers read, after decompression.
+	FilesRead  int64
+	ChunksRead int64
+	BytesRead  int64
+	LinesRead  int64
+	// ChunksProcessed and ChunkErrors count processor results; ChunkErrors includes panics but not
+	// chunks whose LineProcessor failed on some lines only.
+	ChunksProcessed int64
+	ChunkErrors     int64
+	// ItemsEmitted and FilesCompleted count what the ordered collector passed to the sink.
+	ItemsEmitted   int64
+	FilesCompleted int64
+
+	// ChunksInFlight is the number of chunks read but not yet processed.
+	ChunksInFlight int64
+	// ChunkQueue is the number of readers waiting to hand a chunk to a processor, ResultQueue the number
+	// of processors waiting to hand a result downstream. The stage channels are unbuffered, so these
+	// are their occupancy.
+	ChunkQueue  int64
+	ResultQueue int64
+	// ReorderChunks and ReorderBytes describe the results held by the ordered collector;
+	// ReorderChunksPeak is the largest ReorderChunks seen.
+	ReorderChunks     int64
+	ReorderBytes      int64
+	ReorderChunksPeak int64
+
+	// ReadLatency is the time to read and decompress a chunk, ProcessLatency the time the processor
+	// spent on it, including retries. Both are in seconds.
+	ReadLatency    HistogramSnapshot
+	ProcessLatency HistogramSnapshot
+	ChunkBytes     HistogramSnapshot
+	ChunkLines     HistogramSnapshot
+}
+
+// HistogramSnapshot holds cumulative bucket counts: Counts[i] is the number of observations less than
+// or equal to Bounds[i].
+type HistogramSnapshot struct {
+	Bounds []float64
+	Counts []uint64
+	Count  uint64
+	Sum    float64
+}
+
+// Mean returns the average observation, or 0 without observations.
+func (h HistogramSnapshot) Mean() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / float64(h.Count)
+}
+
+// Stats returns a snapshot of the metrics.
+func (m *Metrics) Stats() Stats {
+	if m == nil {
+		return Stats{}
+	}
+	return Stats{
+		FilesRead:         m.filesRead.Load(),
+		ChunksRead:        m.chunksRead.Load(),
+		BytesRead:         m.bytesRead.Load(),
+		LinesRead:         m.linesRead.Load(),
+		ChunksProcessed:   m.chunksProcessed.Load(),
+		ChunkErrors:       m.chunkErrors.Load(),
+		ItemsEmitted:      m.itemsEmitted.Load(),
+		FilesCompleted:    m.filesCompleted.Load(),
+		ChunksInFlight:    m.inFlight.Load(),
+		ChunkQueue:        m.chunkQueue.Load(),
+		ResultQueue:       m.resultQueue.Load(),
+		ReorderChunks:     m.reorderChunks.Load(),
+		ReorderBytes:      m.reorderBytes.Load(),
+		ReorderChunksPeak: m.reorderPeak.Load(),
+		ReadLatency:       m.readLatency.snapshot(),
+		ProcessLatency:    m.processLatency.snapshot(),
+		ChunkBytes:        m.chunkBytes.snapshot(),
+		ChunkLines:        m.chunkLines.snapshot(),
+	}
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	s := m.Stats()
+	bw := bufio.NewWriter(w)
+
+	counter := func(name, help string, v int64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	gauge := func(name, help string, v int64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+	}
+	hist := func(name, help string, h HistogramSnapshot) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+		for i, bound := range h.Bounds {
+			fmt.Fprintf(bw, "%s_bucket{le=%q} %d\n", name, formatFloat(bound), h.Counts[i])
+		}
+		fmt.Fprintf(bw, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n", name, h.Count, name, formatFloat(h.Sum), name, h.Count)
+	}
+
+	counter("iowrapper_files_read_total", "Files read by the chunk workers.", s.FilesRead)
+	counter("iowrapper_chunks_read_total", "Chunks read by the chunk workers.", s.ChunksRead)
+	counter("iowrapper_bytes_read_total", "Bytes read after decompression.", s.BytesRead)
+	counter("iowrapper_lines_read_total", "Lines read.", s.LinesRead)
+	counter("iowrapper_chunks_processed_total", "Chunks processed.", s.ChunksProcessed)
+	counter("iowrapper_chunk_errors_total", "Chunks whose processor failed.", s.ChunkErrors)
+	counter("iowrapper_items_emitted_total", "Items passed to the sink.", s.ItemsEmitted)
+	counter("iowrapper_files_completed_total", "Files fully passed to the sink.", s.FilesCompleted)
+	gauge("iowrapper_chunks_in_flight", "Chunks read but not yet processed.", s.ChunksInFlight)
+	fmt.Fprintf(bw, "# HELP iowrapper_queue_length Items waiting to be handed to the next stage.\n# TYPE iowrapper_queue_length gauge\n")
+	fmt.Fprintf(bw, "iowrapper_queue_length{queue=\"chunks\"} %d\niowrapper_queue_length{queue=\"results\"} %d\n", s.ChunkQueue, s.ResultQueue)
+	gauge("iowrapper_reorder_buffer_chunks", "Results held by the ordered collector.", s.ReorderChunks)
+	gauge("iowrapper_reorder_buffer_bytes", "Input bytes of the results held by the ordered collector.", s.ReorderBytes)
+	gauge("iowrapper_reorder_buffer_chunks_peak", "Largest number of results held by the ordered collector.", s.ReorderChunksPeak)
+	hist("iowrapper_read_duration_seconds", "Time to read and decompress a chunk.", s.ReadLatency)
+	hist("iowrapper_process_duration_seconds", "Time spent processing a chunk.", s.ProcessLatency)
+	hist("iowrapper_chunk_bytes", "Chunk size in bytes.", s.ChunkBytes)
+	hist("iowrapper_chunk_lines", "Lines per chunk.", s.ChunkLines)
+
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = m.WritePrometheus(w)
+}
+
+func formatFloat(v float64) string {
+	return fmt.Sprintf("%g", v)
+}
+
+func (m *Metrics) chunkRead(bytes int, lines int64, took time.Duration) {
+	if m == nil {
+		return
+	}
+	m.chunksRead.Add(1)
+	m.bytesRead.Add(int64(bytes))
+	m.linesRead.Add(lines)
+	m.readLatency.observe(took.Seconds())
+	m.chunkBytes.observe(float64(bytes))
+	m.chunkLines.observe(float64(lines))
+}
+
+func (m *Metrics) fileRead() {
+	if m != nil {
+		m.filesRead.Add(1)
+	}
+}
+
+// queued tracks a reader waiting to hand a chunk to the processors: +1 before the send, -1 after it.
+func (m *Metrics) queued(delta int64) {
+	if m != nil {
+		m.chunkQueue.Add(delta)
+	}
+}
+
+func (m *Metrics) sent() {
+	if m != nil {
+		m.inFlight.Add(1)
+	}
+}
+
+func (m *Metrics) processed(took time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.chunksProcessed.Add(1)
+	if err != nil {
+		m.chunkErrors.Add(1)
+	}
+	m.processLatency.observe(took.Seconds())
+}
+
+// handedOff tracks a processor waiting to hand a result downstream, like queued.
+func (m *Metrics) handedOff(delta int64) {
+	if m != nil {
+		m.resultQueue.Add(delta)
+	}
+}
+
+// done marks a chunk as no longer in flight, whether or not its result was delivered.
+func (m *Metrics) done() {
+	if m != nil {
+		m.inFlight.Add(-1)
+	}
+}
+
+func (m *Metrics) buffered(bytes int) {
+	if m == nil {
+		return
+	}
+	n := m.reorderChunks.Add(1)
+	m.reorderBytes.Add(int64(bytes))
+	for {
+		peak := m.reorderPeak.Load()
+		if n <= peak || m.reorderPeak.CompareAndSwap(peak, n) {
+			return
+		}
+	}
+}
+
+func (m *Metrics) unbuffered(bytes int) {
+	if m == nil {
+		return
+	}
+	m.reorderChunks.Add(-1)
+	m.reorderBytes.Add(-int64(bytes))
+}
+
+func (m *Metrics) emitted(items int, fileDone bool) {
+	if m == nil {
+		return
+	}
+	m.itemsEmitted.Add(int64(items))
+	if fileDone {
+		m.filesCompleted.Add(1)
+	}
+}
+
+// histogram is a fixed-bucket histogram updated with atomics.
+type histogram struct {
+	bounds []float64
+	counts []atomic.Uint64 // per bucket, the last one is +Inf
+	sum    atomic.Uint64   // float64 bits
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]atomic.Uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	if h == nil {
+		return
+	}
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	if h == nil {
+		return HistogramSnapshot{}
+	}
+	s := HistogramSnapshot{
+		Bounds: slices.Clone(h.bounds),
+		Counts: make([]uint64, len(h.bounds)),
+		Sum:    math.Float64frombits(h.sum.Load()),
+	}
+	var total uint64
+	for i := range h.counts {
+		total += h.counts[i].Load()
+		if i < len(h.bounds) {
+			s.Counts[i] = total
+		}
+	}
+	s.Count = total
+	return s
+}
@@ -0,0 +1,166 @@
+package iowrapper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPipelineMetrics(t *testing.T) {
+	const linesPerFile = 3000
+
+	_, files, cleanup := createFakeLogFiles(t, 3, linesPerFile)
+	defer cleanup()
+
+	var size int64
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += info.Size()
+	}
+
+	m := NewMetrics()
+	p := &Pipeline[FakeLogRecord]{
+		Sources:          files,
+		ReaderWorkers:    2,
+		ProcessorWorkers: 4,
+		ChunkSize:        8 * 1024,
+		Processor:        parseChunkToFakeLogRecords,
+		Sink:             func(string, []FakeLogRecord) error { return nil },
+		Metrics:          m,
+	}
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	s := m.Stats()
+	total := int64(len(files) * linesPerFile)
+	if s.FilesRead != 3 || s.FilesCompleted != 3 {
+		t.Fatalf("files read/completed = %d/%d, want 3/3", s.FilesRead, s.FilesCompleted)
+	}
+	if s.BytesRead != size || s.LinesRead != total || s.ItemsEmitted != total {
+		t.Fatalf("bytes/lines/items = %d/%d/%d, want %d/%d/%d", s.BytesRead, s.LinesRead, s.ItemsEmitted, size, total, total)
+	}
+	if s.ChunksRead < 6 || s.ChunksProcessed != s.ChunksRead || s.ChunkErrors != 0 {
+		t.Fatalf("chunks read/processed/errors = %d/%d/%d", s.ChunksRead, s.ChunksProcessed, s.ChunkErrors)
+	}
+	if s.ChunksInFlight != 0 || s.ChunkQueue != 0 || s.ResultQueue != 0 || s.ReorderChunks != 0 || s.ReorderBytes != 0 {
+		t.Fatalf("gauges not back to zero: %+v", s)
+	}
+	if s.ReorderChunksPeak < 1 {
+		t.Fatalf("expected a reorder peak, got %d", s.ReorderChunksPeak)
+	}
+	if s.ProcessLatency.Count != uint64(s.ChunksProcessed) || s.ReadLatency.Count != uint64(s.ChunksRead) {
+		t.Fatalf("latency counts = %d/%d", s.ProcessLatency.Count, s.ReadLatency.Count)
+	}
+	if s.ChunkBytes.Sum != float64(size) || s.ChunkLines.Sum != float64(total) {
+		t.Fatalf("chunk histograms sum to %g bytes and %g lines", s.ChunkBytes.Sum, s.ChunkLines.Sum)
+	}
+	if last := s.ChunkLines.Counts[len(s.ChunkLines.Counts)-1]; last != s.ChunkLines.Count {
+		t.Fatalf("cumulative buckets end at %d, want %d", last, s.ChunkLines.Count)
+	}
+}
+
+func TestMetricsCountsChunkErrors(t *testing.T) {
+	_, files, cleanup := createFakeLogFiles(t, 1, 100)
+	defer cleanup()
+
+	m := NewMetrics()
+	procErr := errors.New("bad chunk")
+	p := &Pipeline[FakeLogRecord]{
+		Sources:       files,
+		FailurePolicy: ContinueOnError,
+		Processor:     func(FileChunk) ([]FakeLogRecord, error) { return nil, procErr },
+		Sink:          func(string, []FakeLogRecord) error { return nil },
+		Metrics:       m,
+	}
+	if err := p.Run(context.Background()); !errors.Is(err, procErr) {
+		t.Fatalf("expected %v, got %v", procErr, err)
+	}
+	if s := m.Stats(); s.ChunkErrors != s.ChunksProcessed || s.ChunkErrors == 0 {
+		t.Fatalf("chunk errors = %d of %d", s.ChunkErrors, s.ChunksProcessed)
+	}
+}
+
+func TestMetricsIgnoresLineErrors(t *testing.T) {
+	_, files, cleanup := createFakeLogFiles(t, 1, 100)
+	defer cleanup()
+
+	m := NewMetrics()
+	p := &Pipeline[string]{
+		Sources: files,
+		Processor: LineProcessor(func(line []byte, pos LinePos) (string, bool, error) {
+			if pos.Line%10 == 0 {
+				return "", false, errors.New("bad line")
+			}
+			return string(line), true, nil
+		}),
+		Sink:    func(string, []string) error { return nil },
+		Metrics: m,
+	}
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s := m.Stats(); s.ChunkErrors != 0 || s.ItemsEmitted != 90 {
+		t.Fatalf("chunk errors/items = %d/%d, want 0/90", s.ChunkErrors, s.ItemsEmitted)
+	}
+}
+
+func TestMetricsStatsCopyBounds(t *testing.T) {
+	m := NewMetrics()
+	s := m.Stats()
+	want := s.ChunkBytes.Bounds[0]
+	s.ChunkBytes.Bounds[0] = -1
+
+	if got := m.Stats().ChunkBytes.Bounds[0]; got != want {
+		t.Fatalf("mutating a snapshot changed the bounds of later ones: got %g, want %g", got, want)
+	}
+	if got := NewMetrics().Stats().ChunkBytes.Bounds[0]; got != want {
+		t.Fatalf("mutating a snapshot changed the bounds of other metrics: got %g, want %g", got, want)
+	}
+}
+
+func TestMetricsPrometheus(t *testing.T) {
+	m := NewMetrics()
+	m.chunkRead(2048, 10, 0)
+	m.processed(0, nil)
+	m.emitted(10, true)
+
+	var buf bytes.Buffer
+	if err := m.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE iowrapper_bytes_read_total counter\niowrapper_bytes_read_total 2048\n",
+		"iowrapper_items_emitted_total 10\n",
+		`iowrapper_queue_length{queue="chunks"} 0`,
+		"# TYPE iowrapper_chunk_bytes histogram\n",
+		`iowrapper_chunk_bytes_bucket{le="1024"} 0`,
+		`iowrapper_chunk_bytes_bucket{le="16384"} 1`,
+		`iowrapper_chunk_bytes_bucket{le="+Inf"} 1`,
+		"iowrapper_chunk_bytes_sum 2048\niowrapper_chunk_bytes_count 1\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("exposition is missing %q:\n%s", want, out)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Body.String() != out {
+		t.Fatal("ServeHTTP output differs from WritePrometheus")
+	}
+
+	var nilMetrics *Metrics
+	nilMetrics.chunkRead(1, 1, 0)
+	if s := nilMetrics.Stats(); s.ChunksRead != 0 {
+		t.Fatalf("nil metrics recorded %+v", s)
+	}
+}
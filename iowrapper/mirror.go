@@ -0,0 +1,312 @@
+package iowrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Mirror processes every file under InputRoot with Pipeline and writes the items of each file, in
+// order, to the same relative path under OutputRoot, e.g. in/a/b.log.gz to out/a/b.log.zst.
+//
+// Outputs are written to a temporary file next to their destination and renamed into place when the
+// file completes, so an output is either missing, left from an earlier run or complete. Files that
+// fail leave their previous output untouched, except under ContinueOnError, which completes a file
+// without the items of its failed chunks. Files whose output is newer than the input are skipped,
+// which makes rerunning an interrupted Mirror cheap.
+type Mirror[T any] struct {
+	// Pipeline configures the run. Mirror sets Sources and Sink and calls Hooks after its own hooks;
+	// Checkpoint, Sample and DryRun are not supported. With FS set, InputRoot is a path in FS.
+	Pipeline Pipeline[T]
+	// InputRoot is the directory whose regular files are processed, recursively.
+	InputRoot string
+	// OutputRoot is the directory the outputs are written to. It is skipped when it lies inside
+	// InputRoot.
+	OutputRoot string
+	// Include, when set, selects the files to process by their slash-separated path relative to
+	// InputRoot. Defaults to every regular file.
+	Include func(rel string) bool
+	// Compression is the suffix appended to the output paths, after removing the compression suffix
+	// of the input. ".gz", ".zst" and ".zstd" compress the outputs as with Writer; "" writes them plain.
+	Compression string
+	// Write writes one item to an output. Defaults to writing strings and byte slices followed by a
+	// newline and formatting other items with fmt.Fprintln.
+	Write func(w io.Writer, item T) error
+	// Force processes every file, including those whose output is up to date.
+	Force bool
+	// OnSkip, when set, is called for every file skipped because its output is up to date.
+	OnSkip func(input, output string)
+}
+
+// Run walks InputRoot and processes the files whose outputs are missing or out of date. The returned
+// error is that of Pipeline.Run, joined with the failures to move outputs into place.
+func (m *Mirror[T]) Run(ctx context.Context) error {
+	if m.Pipeline.Checkpoint != nil {
+		return errors.New("iowrapper: mirror does not support checkpoints")
+	}
+	// Partial outputs would be newer than their inputs and taken as up to date by the next run.
+	if !m.Pipeline.Sample.isZero() || m.Pipeline.DryRun {
+		return errors.New("iowrapper: mirror does not support sampled or dry runs")
+	}
+	sources, outputs, err := m.plan()
+	if err != nil {
+		return err
+	}
+	write := m.Write
+	if write == nil {
+		write = writeItem[T]
+	}
+
+	p := m.Pipeline
+	p.Sources = sources
+
+	// The hooks and the sink all run on the collector goroutine, so open needs no lock.
+	open := make(map[string]*mirrorOutput)
+	var errs []error
+	hooks := m.Pipeline.Hooks
+	p.Hooks.OnStart = func(file string) {
+		out := &mirrorOutput{path: outputs[file]}
+		out.err = out.create(detectCompression(m.Compression, nil))
+		open[file] = out
+		if hooks.OnStart != nil {
+			hooks.OnStart(file)
+		}
+	}
+	p.Sink = func(file string, items []T) error {
+		out := open[file]
+		if out.err != nil {
+			return out.err
+		}
+		for _, item := range items {
+			if err := write(out.w, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	p.Hooks.OnComplete = func(stats FileStats) {
+		out := open[stats.File]
+		delete(open, stats.File)
+		if err := out.commit(); err != nil {
+			errs = append(errs, &FileError{File: stats.File, Err: err})
+			if hooks.OnFailed != nil {
+				hooks.OnFailed(stats.File, err)
+			}
+			return
+		}
+		if hooks.OnComplete != nil {
+			hooks.OnComplete(stats)
+		}
+	}
+	p.Hooks.OnFailed = func(file string, err error) {
+		if out := open[file]; out != nil {
+			out.abort()
+			delete(open, file)
+		}
+		if hooks.OnFailed != nil {
+			hooks.OnFailed(file, err)
+		}
+	}
+
+	err = p.Run(ctx)
+	// Outputs still open belong to files cut short by a stopped run.
+	for _, out := range open {
+		out.abort()
+	}
+	return errors.Join(append([]error{err}, errs...)...)
+}
+
+// plan walks InputRoot and returns the files to process, in lexical order, with their output paths.
+func (m *Mirror[T]) plan() ([]string, map[string]string, error) {
+	fsys := m.Pipeline.FS
+	outputRoot, err := filepath.Abs(m.OutputRoot)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var sources []string
+	outputs := make(map[string]string)
+	inputs := make(map[string]string)
+	walk := func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if fsys == nil {
+				if abs, err := filepath.Abs(file); err == nil && abs == outputRoot {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := m.relative(file)
+		if err != nil {
+			return err
+		}
+		if m.Include != nil && !m.Include(rel) {
+			return nil
+		}
+		output := filepath.Join(m.OutputRoot, filepath.FromSlash(trimCompressionSuffix(rel)+m.Compression))
+		if other, ok := inputs[output]; ok {
+			return fmt.Errorf("iowrapper: %s and %s both map to %s", other, file, output)
+		}
+		inputs[output] = file
+
+		if !m.Force {
+			if upToDate, err := m.upToDate(file, output); err != nil {
+				return err
+			} else if upToDate {
+				if m.OnSkip != nil {
+					m.OnSkip(file, output)
+				}
+				return nil
+			}
+		}
+		sources = append(sources, file)
+		outputs[file] = output
+		return nil
+	}
+
+	if fsys == nil {
+		err = filepath.WalkDir(m.InputRoot, walk)
+	} else {
+		err = fs.WalkDir(fsys, m.InputRoot, walk)
+	}
+	return sources, outputs, err
+}
+
+// relative returns file relative to InputRoot, slash-separated.
+func (m *Mirror[T]) relative(file string) (string, error) {
+	if m.Pipeline.FS != nil {
+		if m.InputRoot == "." {
+			return file, nil
+		}
+		return strings.TrimPrefix(file, path.Clean(m.InputRoot)+"/"), nil
+	}
+	rel, err := filepath.Rel(m.InputRoot, file)
+	return filepath.ToSlash(rel), err
+}
+
+// upToDate reports whether output exists and is newer than input.
+func (m *Mirror[T]) upToDate(input, output string) (bool, error) {
+	outInfo, err := os.Stat(output)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	var inInfo fs.FileInfo
+	if m.Pipeline.FS == nil {
+		inInfo, err = os.Stat(input)
+	} else {
+		inInfo, err = fs.Stat(m.Pipeline.FS, input)
+	}
+	if err != nil {
+		return false, err
+	}
+	return outInfo.ModTime().After(inInfo.ModTime()), nil
+}
+
+func trimCompressionSuffix(name string) string {
+	for _, suffix := range []string{".gz", ".zst", ".zstd"} {
+		if trimmed, ok := strings.CutSuffix(name, suffix); ok {
+			return trimmed
+		}
+	}
+	return name
+}
+
+// writeItem is the default Mirror.Write.
+func writeItem[T any](w io.Writer, item T) error {
+	var err error
+	switch v := any(item).(type) {
+	case string:
+		if _, err = io.WriteString(w, v); err == nil {
+			_, err = io.WriteString(w, "\n")
+		}
+	case []byte:
+		if _, err = w.Write(v); err == nil {
+			_, err = io.WriteString(w, "\n")
+		}
+	default:
+		_, err = fmt.Fprintln(w, item)
+	}
+	return err
+}
+
+// mirrorOutput is an output being written to a temporary file.
+type mirrorOutput struct {
+	path   string
+	tmp    *os.File
+	w      io.Writer
+	closer io.Closer
+	// err is the error creating the output, reported by the sink or on commit.
+	err error
+}
+
+func (o *mirrorOutput) create(c compression) error {
+	if err := os.MkdirAll(filepath.Dir(o.path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(o.path), "."+filepath.Base(o.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	w, closer, err := compressWriter(syncCloser{tmp}, c, 64*1024)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	o.tmp, o.w, o.closer = tmp, w, closer
+	return nil
+}
+
+// commit finishes the temporary file and renames it over the output.
+func (o *mirrorOutput) commit() error {
+	if o.err != nil {
+		return o.err
+	}
+	err := o.closer.Close()
+	if err == nil {
+		err = os.Chmod(o.tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(o.tmp.Name(), o.path)
+	}
+	if err != nil {
+		os.Remove(o.tmp.Name())
+	}
+	return err
+}
+
+// abort discards the temporary file.
+func (o *mirrorOutput) abort() {
+	if o.err != nil {
+		return
+	}
+	_ = o.closer.Close()
+	os.Remove(o.tmp.Name())
+}
+
+// syncCloser flushes a file to disk before closing it, so that a renamed output survives a crash.
+type syncCloser struct {
+	*os.File
+}
+
+func (f syncCloser) Close() error {
+	err := f.Sync()
+	if cerr := f.File.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,171 @@
+package iowrapper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func upperLines(chunk FileChunk) ([]string, error) {
+	var out []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(chunk.Chunk.Data), "\n"), "\n") {
+		if line == "fail" {
+			return nil, errors.New("bad line")
+		}
+		if line != "" {
+			out = append(out, strings.ToUpper(line))
+		}
+	}
+	return out, nil
+}
+
+func TestMirror(t *testing.T) {
+	in := t.TempDir()
+	out := filepath.Join(t.TempDir(), "out")
+	inputs := map[string][]byte{
+		"a.log":          []byte("one\ntwo\n"),
+		"sub/b.log.gz":   gzipBytes(t, "three\n"),
+		"sub/deep/c.txt": []byte("four\nfive\nsix\n"),
+		"empty.log":      nil,
+	}
+	for name, data := range inputs {
+		path := filepath.Join(in, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var completed []string
+	m := &Mirror[string]{
+		Pipeline: Pipeline[string]{
+			ProcessorWorkers: 2,
+			ChunkSize:        4,
+			Processor:        upperLines,
+			Hooks: FileHooks{OnComplete: func(stats FileStats) {
+				completed = append(completed, stats.File)
+			}},
+		},
+		InputRoot:   in,
+		OutputRoot:  out,
+		Compression: ".zst",
+	}
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(completed) != len(inputs) {
+		t.Fatalf("user hook saw %v", completed)
+	}
+
+	want := map[string][]string{
+		"a.log.zst":          {"ONE", "TWO"},
+		"sub/b.log.zst":      {"THREE"},
+		"sub/deep/c.txt.zst": {"FOUR", "FIVE", "SIX"},
+		"empty.log.zst":      nil,
+	}
+	for name, lines := range want {
+		got, err := ReadLines(filepath.Join(out, name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, lines) {
+			t.Fatalf("%s: got %v, want %v", name, got, lines)
+		}
+	}
+
+	// A rerun skips everything; touching an input makes it stale again.
+	var skipped []string
+	m.OnSkip = func(input, _ string) { skipped = append(skipped, input) }
+	completed = nil
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("rerun: %v", err)
+	}
+	if len(skipped) != len(inputs) || len(completed) != 0 {
+		t.Fatalf("rerun skipped %v, completed %v", skipped, completed)
+	}
+
+	stale := filepath.Join(in, "a.log")
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(stale, future, future); err != nil {
+		t.Fatal(err)
+	}
+	skipped = nil
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("third run: %v", err)
+	}
+	if !reflect.DeepEqual(completed, []string{stale}) || len(skipped) != len(inputs)-1 {
+		t.Fatalf("third run skipped %v, completed %v", skipped, completed)
+	}
+}
+
+func TestMirrorFailureKeepsPreviousOutput(t *testing.T) {
+	in := t.TempDir()
+	out := t.TempDir()
+	for name, data := range map[string]string{"good.log": "ok\n", "bad.log": "x\nfail\n"} {
+		if err := os.WriteFile(filepath.Join(in, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	previous := []byte("previous\n")
+	if err := os.WriteFile(filepath.Join(out, "bad.log.gz"), previous, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(out, "bad.log.gz"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Mirror[string]{
+		Pipeline: Pipeline[string]{
+			Processor:     upperLines,
+			FailurePolicy: SkipFile,
+		},
+		InputRoot:   in,
+		OutputRoot:  out,
+		Compression: ".gz",
+	}
+	err := m.Run(context.Background())
+	var report *FailureReport
+	if !errors.As(err, &report) || len(report.Files()) != 1 || filepath.Base(report.Files()[0]) != "bad.log" {
+		t.Fatalf("expected a report for bad.log, got %v", err)
+	}
+
+	if got, err := ReadLines(filepath.Join(out, "good.log.gz")); err != nil || !reflect.DeepEqual(got, []string{"OK"}) {
+		t.Fatalf("good.log.gz = %v, %v", got, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(out, "bad.log.gz")); err != nil || !bytes.Equal(data, previous) {
+		t.Fatalf("bad.log.gz was replaced: %q, %v", data, err)
+	}
+	entries, err := os.ReadDir(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("temporary files left behind: %v", entries)
+	}
+}
+
+func TestMirrorRejectsCollidingOutputs(t *testing.T) {
+	in := t.TempDir()
+	for _, name := range []string{"a.log", "a.log.gz"} {
+		if err := os.WriteFile(filepath.Join(in, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := &Mirror[string]{
+		Pipeline:   Pipeline[string]{Processor: upperLines},
+		InputRoot:  in,
+		OutputRoot: t.TempDir(),
+	}
+	if err := m.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "both map to") {
+		t.Fatalf("expected a collision error, got %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package iowrapper
+
+import "io/fs"
+
+// StageOption configures the low-level pipeline stages. Stages share the same option type and
+// ignore the settings that do not apply to them, so one option slice can be passed to all of them.
+type StageOption func(*stageOptions)
+
+type stageOptions struct {
+	splitter   SplitterFunc
+	policy     FailurePolicy
+	budget     *ReorderBudget
+	hooks      FileHooks
+	inputOrder []string
+	checkpoint *Checkpoint
+	retry      RetryPolicy
+	deadLetter *DeadLetterWriter
+	metrics    *Metrics
+	progress   *Progress
+	autoscale  *Autoscaler
+	schedule   Schedule
+	orderLog   *orderLog
+	fsys       fs.FS
+	sample     *Sampling
+	// overall is the shared reservoir of a ReservoirOverall sample, set up by StartChunkWorkers.
+	overall *overallReservoir
+}
+
+func newStageOptions(opts []StageOption) stageOptions {
+	var o stageOptions
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&o)
+		}
+	}
+	return o
+}
+
+// WithSplitter selects the function used by StartChunkWorkers to split files into chunks.
+// The default is SliceToBytesChunks2.
+func WithSplitter(fn SplitterFunc) StageOption {
+	return func(o *stageOptions) {
+		if fn != nil {
+			o.splitter = fn
+		}
+	}
+}
+
+// WithFailurePolicy selects how stages react to a failing file. The default is FailFast.
+func WithFailurePolicy(policy FailurePolicy) StageOption {
+	return func(o *stageOptions) {
+		o.policy = policy
+	}
+}
+
+// WithReorderBudget bounds the work outstanding between StartChunkWorkers and the ordered collector.
+// The same budget must be passed to both stages.
+func WithReorderBudget(b *ReorderBudget) StageOption {
+	return func(o *stageOptions) {
+		o.budget = b
+	}
+}
+
+// WithFileHooks registers per-file lifecycle hooks with the ordered collector.
+func WithFileHooks(h FileHooks) StageOption {
+	return func(o *stageOptions) {
+		o.hooks = h
+	}
+}
+
+// WithInputOrder makes the ordered collector emit whole files in the given order, which should be the
+// order in which StartFileProducer hands out the files, after any WithSchedule. A file is held back
+// until every file before it has completed or failed, so the output is deterministic across runs.
+// Files not in the list are emitted as they come.
+func WithInputOrder(files []string) StageOption {
+	return func(o *stageOptions) {
+		o.inputOrder = files
+	}
+}
+
+// WithCheckpoint makes StartChunkWorkers skip completed files and resume in-flight ones, and makes the
+// ordered collector record progress. The same checkpoint must be passed to both stages.
+func WithCheckpoint(c *Checkpoint) StageOption {
+	return func(o *stageOptions) {
+		o.checkpoint = c
+	}
+}
+
+// WithRetry makes StartChunkProcessors retry chunks whose processor fails.
+func WithRetry(policy RetryPolicy) StageOption {
+	return func(o *stageOptions) {
+		o.retry = policy
+	}
+}
+
+// WithDeadLetter makes StartChunkProcessors write chunks that still fail after retries to w instead of
+// failing the run.
+func WithDeadLetter(w *DeadLetterWriter) StageOption {
+	return func(o *stageOptions) {
+		o.deadLetter = w
+	}
+}
+
+// WithMetrics records throughput, queue depth and latency in m. Pass the same Metrics to every stage.
+func WithMetrics(m *Metrics) StageOption {
+	return func(o *stageOptions) {
+		o.metrics = m
+	}
+}
+
+// WithProgress makes StartChunkWorkers report the input it consumes to p.
+func WithProgress(p *Progress) StageOption {
+	return func(o *stageOptions) {
+		o.progress = p
+	}
+}
+
+// WithAutoscale lets a adapt the chunk size of StartChunkWorkers and the worker counts of
+// StartChunkWorkers and StartChunkProcessors. Pass the same Autoscaler to both stages.
+func WithAutoscale(a *Autoscaler) StageOption {
+	return func(o *stageOptions) {
+		o.autoscale = a
+	}
+}
+
+// WithSchedule makes StartFileProducer hand out the files in the order chosen by s.
+func WithSchedule(s Schedule) StageOption {
+	return func(o *stageOptions) {
+		o.schedule = s
+	}
+}
+
+// WithFS makes StartChunkWorkers open files in fsys instead of on the operating system.
+func WithFS(fsys fs.FS) StageOption {
+	return func(o *stageOptions) {
+		o.fsys = fsys
+	}
+}
@@ -0,0 +1,387 @@
+package iowrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrIncomplete is reported for a file whose chunks stopped arriving before its last one, when the
+// input of StreamOrdered or CollectOrdered closes with chunks of it, or of files behind it in the
+// input order, still buffered.
+var ErrIncomplete = errors.New("input closed before the file was complete")
+
+// FileHooks receives per-file lifecycle events from StreamOrdered and CollectOrdered. The hooks run
+// on the collector goroutine, in order with the sink calls of the same file, so they may safely open
+// and close per-file outputs used by the sink. Any hook may be nil.
+type FileHooks struct {
+	// OnStart is called before the first sink call of a file.
+	OnStart func(file string)
+	// OnComplete is called after the last sink call of a file.
+	OnComplete func(FileStats)
+	// OnFailed is called when a file fails to read, or one of its chunks fails to process under
+	// FailFast or SkipFile. Under ContinueOnError the rest of the file still flows and it gets
+	// OnComplete, with the failed chunks counted in FileStats.FailedChunks.
+	OnFailed func(file string, err error)
+	// OnLineErrors is called with the failed lines of a chunk processed by a LineProcessor,
+	// right after the sink call for that chunk.
+	OnLineErrors func(file string, errs []LineError)
+}
+
+// FileStats summarises a completed file.
+type FileStats struct {
+	File   string
+	Chunks int
+	Lines  int64
+	Items  int
+	// LineErrors counts the lines that failed in a LineProcessor.
+	LineErrors int
+	// FailedChunks counts the chunks that failed to process under ContinueOnError.
+	FailedChunks int
+	// Bytes is the number of bytes read from the file after decompression.
+	Bytes int64
+	// Duration is the time from the reader picking up the file to its last chunk reaching the sink.
+	Duration time.Duration
+}
+
+// orderedCollector restores per-file chunk order for StreamOrdered and CollectOrdered. With an input
+// order it also holds back every file until all files before it have finished.
+type orderedCollector[T any] struct {
+	opts  stageOptions
+	sink  func(string, []T) error
+	files map[string]*fileOrder[T]
+
+	sequence []string
+	position map[string]int
+	head     int
+	log      *orderLog
+
+	// failed holds the files abandoned under SkipFile; report collects the processing failures
+	// that did not stop the run.
+	failed map[string]struct{}
+	report FailureReport
+}
+
+// fileOrder tracks the next chunk expected from a file and the chunks that arrived early.
+type fileOrder[T any] struct {
+	next       int
+	items      int
+	lineErrors int
+	// failedChunks counts the chunks that failed under ContinueOnError. The checkpoint is not
+	// advanced once a file has one, so that a resumed run processes the failed data again.
+	failedChunks int
+	started      bool
+	pending      map[int]ProcessedChunk[T]
+}
+
+func newOrderedCollector[T any](sink func(string, []T) error, opts []StageOption) *orderedCollector[T] {
+	c := &orderedCollector[T]{
+		opts:   newStageOptions(opts),
+		sink:   sink,
+		files:  make(map[string]*fileOrder[T]),
+		failed: make(map[string]struct{}),
+	}
+	if c.opts.inputOrder != nil || c.opts.orderLog != nil {
+		c.sequence = []string{}
+		c.position = make(map[string]int, len(c.opts.inputOrder))
+		c.extendOrder(c.opts.inputOrder)
+		c.log = c.opts.orderLog
+	}
+	return c
+}
+
+func (c *orderedCollector[T]) extendOrder(files []string) {
+	for _, file := range files {
+		if _, dup := c.position[file]; dup {
+			continue
+		}
+		c.position[file] = len(c.sequence)
+		c.sequence = append(c.sequence, file)
+	}
+}
+
+func (c *orderedCollector[T]) run(ctx context.Context, in <-chan ProcessedChunk[T]) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case res, ok := <-in:
+			if !ok {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				c.report.add(c.incomplete())
+				if len(c.report.Errors) > 0 {
+					return &c.report
+				}
+				return nil
+			}
+			if err := c.add(res); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// incomplete returns a *FileError naming the file that kept buffered chunks from reaching the sink once
+// the input has closed: the head of the input order when files wait behind it, otherwise a file
+// still waiting for one of its own chunks. The buffered chunks are dropped.
+func (c *orderedCollector[T]) incomplete() error {
+	var waiting []string
+	held := false
+	for file, state := range c.files {
+		if len(state.pending) == 0 {
+			continue
+		}
+		waiting = append(waiting, file)
+		if pos, ok := c.position[file]; ok && pos > c.head {
+			held = true
+		}
+		for _, res := range state.pending {
+			c.release(res)
+		}
+	}
+	if len(waiting) == 0 {
+		return nil
+	}
+	slices.Sort(waiting)
+	stuck := waiting[0]
+	if held {
+		stuck = c.sequence[c.head]
+	}
+	return &FileError{File: stuck, Err: fmt.Errorf("%w: dropped buffered chunks of %d file(s)", ErrIncomplete, len(waiting))}
+}
+
+func (c *orderedCollector[T]) add(res ProcessedChunk[T]) error {
+	if c.log != nil {
+		// A file is logged before it is handed to the readers, so it is known by now.
+		c.extendOrder(c.log.since(len(c.sequence)))
+	}
+	c.opts.metrics.buffered(res.Bytes)
+	if _, skipped := c.failed[res.File]; skipped {
+		c.release(res)
+		return nil
+	}
+	if res.Err != nil {
+		switch c.opts.policy {
+		case SkipFile:
+			c.release(res)
+			c.report.add(&FileError{File: res.File, Err: res.Err})
+			return c.skip(res.File, res.Err)
+		case ContinueOnError:
+			// Keep the chunk as an empty result so that the rest of the file still flows; emit
+			// sees the error and keeps the checkpoint from moving past the chunk.
+			c.report.add(&FileError{File: res.File, Err: res.Err})
+			res.Items = nil
+		default:
+			c.release(res)
+			c.fail(res.File, res.Err)
+			return res.Err
+		}
+	}
+
+	// Every result takes part in ordering, including empty ones: skipping them would leave
+	// the following chunks of the file waiting for an index that never arrives.
+	state := c.files[res.File]
+	if state == nil {
+		state = &fileOrder[T]{next: c.opts.checkpoint.firstChunk(res.File), pending: make(map[int]ProcessedChunk[T])}
+		c.files[res.File] = state
+	}
+	state.pending[res.ChunkIndex] = res
+	return c.flush(res.File)
+}
+
+// flush emits the contiguous chunks of file and, when the file finishes while it is at the head of
+// the input order, continues with the files that were waiting behind it.
+func (c *orderedCollector[T]) flush(file string) error {
+	for {
+		if !c.active(file) {
+			return nil
+		}
+		state := c.files[file]
+		if state == nil {
+			return nil
+		}
+		res, ok := state.pending[state.next]
+		if !ok {
+			return nil
+		}
+		delete(state.pending, state.next)
+
+		if err := c.emit(state, res); err != nil {
+			return err
+		}
+		if res.Summary != nil {
+			next, ok := c.advance(file)
+			if !ok {
+				return nil
+			}
+			file = next
+		}
+	}
+}
+
+// active reports whether file may be emitted: always without an input order, otherwise only
+// while it is the head of the order. Files missing from the order are never held back.
+func (c *orderedCollector[T]) active(file string) bool {
+	if c.sequence == nil {
+		return true
+	}
+	pos, ok := c.position[file]
+	return !ok || pos == c.head
+}
+
+// advance moves the head of the input order past the finished file, and past any skipped files
+// behind it, and returns the new head.
+func (c *orderedCollector[T]) advance(finished string) (string, bool) {
+	if c.sequence == nil {
+		return "", false
+	}
+	if pos, ok := c.position[finished]; !ok || pos != c.head {
+		return "", false
+	}
+	for {
+		c.head++
+		if c.head >= len(c.sequence) {
+			return "", false
+		}
+		if _, skipped := c.failed[c.sequence[c.head]]; !skipped {
+			return c.sequence[c.head], true
+		}
+	}
+}
+
+// emit hands an in-order chunk to the sink and fires the lifecycle hooks around it.
+func (c *orderedCollector[T]) emit(state *fileOrder[T], res ProcessedChunk[T]) error {
+	defer c.release(res)
+
+	hooks := c.opts.hooks
+	if res.Summary != nil && res.Summary.Err != nil {
+		delete(c.files, res.File)
+		if hooks.OnFailed != nil {
+			hooks.OnFailed(res.File, res.Summary.Err)
+		}
+		return nil
+	}
+
+	if !state.started {
+		state.started = true
+		if hooks.OnStart != nil {
+			hooks.OnStart(res.File)
+		}
+	}
+	if len(res.Items) > 0 {
+		if err := c.sink(res.File, res.Items); err != nil {
+			// A consumer leaving a Seq early is not a failure of the file.
+			if !errors.Is(err, errSeqStopped) {
+				c.fail(res.File, err)
+			}
+			return err
+		}
+	}
+	state.items += len(res.Items)
+	state.next++
+	if res.Err != nil {
+		state.failedChunks++
+	}
+	c.opts.metrics.emitted(len(res.Items), res.Summary != nil)
+	if len(res.LineErrors) > 0 {
+		state.lineErrors += len(res.LineErrors)
+		if hooks.OnLineErrors != nil {
+			hooks.OnLineErrors(res.File, res.LineErrors)
+		}
+	}
+
+	if cp := c.opts.checkpoint; cp != nil && state.failedChunks == 0 {
+		var err error
+		if res.Summary != nil {
+			err = cp.complete(res.File)
+		} else {
+			err = cp.advance(res.File, res.ChunkIndex, res.Offset+int64(res.Bytes), res.FirstLine-1+int64(res.Lines))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if res.Summary != nil {
+		delete(c.files, res.File)
+		if hooks.OnComplete != nil {
+			hooks.OnComplete(FileStats{
+				File:         res.File,
+				Chunks:       res.Summary.Chunks,
+				Lines:        res.Summary.Lines,
+				Items:        state.items,
+				LineErrors:   state.lineErrors,
+				FailedChunks: state.failedChunks,
+				Bytes:        res.Summary.Bytes,
+				Duration:     time.Since(res.Summary.Started),
+			})
+		}
+	}
+	return nil
+}
+
+// skip abandons file under SkipFile: its buffered chunks are dropped, later ones are ignored and
+// files waiting behind it in the input order are released.
+func (c *orderedCollector[T]) skip(file string, err error) error {
+	if state := c.files[file]; state != nil {
+		for _, res := range state.pending {
+			c.release(res)
+		}
+	}
+	c.failed[file] = struct{}{}
+	c.fail(file, err)
+
+	if next, ok := c.advance(file); ok {
+		return c.flush(next)
+	}
+	return nil
+}
+
+func (c *orderedCollector[T]) fail(file string, err error) {
+	delete(c.files, file)
+	if c.opts.hooks.OnFailed != nil {
+		c.opts.hooks.OnFailed(file, err)
+	}
+}
+
+func (c *orderedCollector[T]) release(res ProcessedChunk[T]) {
+	c.opts.metrics.unbuffered(res.Bytes)
+	if c.opts.budget != nil {
+		c.opts.budget.release(res.File, res.Bytes)
+	}
+}
+
+// orderLog records the input order of a run whose files are produced lazily. The producer adds every
+// file before handing it to the readers; the collector picks up new entries as chunks arrive.
+type orderLog struct {
+	mu    sync.Mutex
+	files []string
+	seen  map[string]struct{}
+}
+
+// add appends file and reports false if it was added before.
+func (l *orderLog) add(file string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seen == nil {
+		l.seen = make(map[string]struct{})
+	}
+	if _, dup := l.seen[file]; dup {
+		return false
+	}
+	l.seen[file] = struct{}{}
+	l.files = append(l.files, file)
+	return true
+}
+
+// since returns the files added after the first n.
+func (l *orderLog) since(n int) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.files[n:]
+}
@@ -0,0 +1,295 @@
+package iowrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type hookRecorder struct {
+	events map[string][]string
+	stats  map[string]FileStats
+	failed map[string]error
+}
+
+func newHookRecorder() *hookRecorder {
+	return &hookRecorder{
+		events: make(map[string][]string),
+		stats:  make(map[string]FileStats),
+		failed: make(map[string]error),
+	}
+}
+
+func (r *hookRecorder) hooks() FileHooks {
+	return FileHooks{
+		OnStart: func(file string) {
+			r.events[file] = append(r.events[file], "start")
+		},
+		OnComplete: func(stats FileStats) {
+			r.events[stats.File] = append(r.events[stats.File], "complete")
+			r.stats[stats.File] = stats
+		},
+		OnFailed: func(file string, err error) {
+			r.events[file] = append(r.events[file], "failed")
+			r.failed[file] = err
+		},
+	}
+}
+
+func (r *hookRecorder) sink(file string, items []FakeLogRecord) error {
+	events := r.events[file]
+	if len(events) == 0 || events[len(events)-1] == "complete" {
+		return fmt.Errorf("sink called for %s outside of start/complete: %v", file, events)
+	}
+	if events[len(events)-1] != "sink" {
+		r.events[file] = append(events, "sink")
+	}
+	return nil
+}
+
+func TestStreamOrderedFileHooks(t *testing.T) {
+	const linesPerFile = 3000
+
+	dir, files, cleanup := createFakeLogFiles(t, 2, linesPerFile)
+	defer cleanup()
+
+	empty := filepath.Join(dir, "empty.log")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	filtered := filepath.Join(dir, "filtered.log")
+	if err := os.WriteFile(filtered, []byte("skip me\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.log")
+
+	processor := func(chunk FileChunk) ([]FakeLogRecord, error) {
+		if chunk.File == filtered {
+			return nil, nil
+		}
+		return parseChunkToFakeLogRecords(chunk)
+	}
+
+	rec := newHookRecorder()
+	p := &Pipeline[FakeLogRecord]{
+		Sources:          append(files, empty, filtered, missing),
+		ReaderWorkers:    2,
+		ProcessorWorkers: 4,
+		ChunkSize:        8 * 1024,
+		FailurePolicy:    ContinueOnError,
+		Processor:        processor,
+		Sink:             rec.sink,
+		Hooks:            rec.hooks(),
+	}
+
+	err := p.Run(context.Background())
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected missing file error, got %v", err)
+	}
+
+	for _, path := range files {
+		if got, want := rec.events[path], []string{"start", "sink", "complete"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("events for %s = %v, want %v", path, got, want)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats := rec.stats[path]
+		if stats.Lines != linesPerFile || stats.Items != linesPerFile || stats.Bytes != info.Size() {
+			t.Fatalf("stats for %s = %+v, want %d lines/items and %d bytes", path, stats, linesPerFile, info.Size())
+		}
+		if stats.Chunks < 2 || stats.Duration <= 0 {
+			t.Fatalf("stats for %s = %+v, want several chunks and a duration", path, stats)
+		}
+	}
+
+	for _, path := range []string{empty, filtered} {
+		if got, want := rec.events[path], []string{"start", "complete"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("events for %s = %v, want %v", path, got, want)
+		}
+		if rec.stats[path].Items != 0 {
+			t.Fatalf("expected no items for %s, got %+v", path, rec.stats[path])
+		}
+	}
+	if rec.stats[filtered].Lines != 1 {
+		t.Fatalf("expected 1 line for %s, got %+v", filtered, rec.stats[filtered])
+	}
+
+	if got, want := rec.events[missing], []string{"failed"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("events for %s = %v, want %v", missing, got, want)
+	}
+	if !errors.Is(rec.failed[missing], os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist for %s, got %v", missing, rec.failed[missing])
+	}
+}
+
+func TestCollectOrderedFailedChunkFiresHook(t *testing.T) {
+	procErr := errors.New("bad chunk")
+	in := make(chan ProcessedChunk[int], 2)
+	in <- ProcessedChunk[int]{File: "a", ChunkIndex: 0, Items: []int{1}}
+	in <- ProcessedChunk[int]{File: "a", ChunkIndex: 1, Err: procErr}
+	close(in)
+
+	rec := newHookRecorder()
+	_, err := CollectOrdered(context.Background(), in, WithFileHooks(rec.hooks()))
+	if !errors.Is(err, procErr) {
+		t.Fatalf("expected %v, got %v", procErr, err)
+	}
+	if got, want := rec.events["a"], []string{"start", "failed"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+}
+
+func TestCollectOrderedCountsFailedChunksOnContinue(t *testing.T) {
+	procErr := errors.New("bad chunk")
+	in := make(chan ProcessedChunk[int], 3)
+	in <- ProcessedChunk[int]{File: "a", ChunkIndex: 0, Items: []int{1}}
+	in <- ProcessedChunk[int]{File: "a", ChunkIndex: 1, Err: procErr}
+	in <- ProcessedChunk[int]{File: "a", ChunkIndex: 2, Items: []int{3}, Summary: &FileSummary{Chunks: 3}}
+	close(in)
+
+	rec := newHookRecorder()
+	_, err := CollectOrdered(context.Background(), in, WithFailurePolicy(ContinueOnError), WithFileHooks(rec.hooks()))
+	if !errors.Is(err, procErr) {
+		t.Fatalf("expected %v, got %v", procErr, err)
+	}
+	if got, want := rec.events["a"], []string{"start", "complete"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	if stats := rec.stats["a"]; stats.FailedChunks != 1 || stats.Items != 2 {
+		t.Fatalf("stats = %+v, want 1 failed chunk and 2 items", stats)
+	}
+}
+
+func TestCollectOrderedEmptyResultsAdvanceOrder(t *testing.T) {
+	in := make(chan ProcessedChunk[int], 4)
+	in <- ProcessedChunk[int]{File: "a", ChunkIndex: 2, Items: []int{3}}
+	in <- ProcessedChunk[int]{File: "a", ChunkIndex: 1, Items: []int{}}
+	in <- ProcessedChunk[int]{File: "a", ChunkIndex: 3, Items: []int{4}}
+	in <- ProcessedChunk[int]{File: "a", ChunkIndex: 0}
+	close(in)
+
+	results, err := CollectOrdered(context.Background(), in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := results["a"], []int{3, 4}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("results = %v, want %v", got, want)
+	}
+}
+
+func TestPipelineInputOrder(t *testing.T) {
+	const linesPerFile = 2000
+
+	_, files, cleanup := createFakeLogFiles(t, 5, linesPerFile)
+	defer cleanup()
+
+	// Drop every other chunk's items and slow down the first file so that later files finish first.
+	processor := func(chunk FileChunk) ([]FakeLogRecord, error) {
+		if chunk.File == files[0] {
+			time.Sleep(2 * time.Millisecond)
+		}
+		records, err := parseChunkToFakeLogRecords(chunk)
+		if chunk.Chunk.Index%2 == 1 {
+			return nil, err
+		}
+		return records, err
+	}
+
+	var order []string
+	var records int
+	p := &Pipeline[FakeLogRecord]{
+		Sources:          files,
+		ReaderWorkers:    3,
+		ProcessorWorkers: 4,
+		ChunkSize:        4 * 1024,
+		InputOrder:       true,
+		Processor:        processor,
+		Sink: func(file string, items []FakeLogRecord) error {
+			if len(order) == 0 || order[len(order)-1] != file {
+				order = append(order, file)
+			}
+			records += len(items)
+			return nil
+		},
+	}
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	if !reflect.DeepEqual(order, files) {
+		t.Fatalf("files emitted in order %v, want %v", order, files)
+	}
+	if records == 0 || records >= len(files)*linesPerFile {
+		t.Fatalf("unexpected record count %d", records)
+	}
+}
+
+func TestCollectOrderedReportsIncompleteFile(t *testing.T) {
+	t.Run("missing chunk", func(t *testing.T) {
+		in := make(chan ProcessedChunk[int], 2)
+		in <- ProcessedChunk[int]{File: "a", ChunkIndex: 0, Items: []int{1}}
+		in <- ProcessedChunk[int]{File: "a", ChunkIndex: 2, Items: []int{3}, Summary: &FileSummary{}}
+		close(in)
+
+		_, err := CollectOrdered(context.Background(), in)
+		var fe *FileError
+		if !errors.Is(err, ErrIncomplete) || !errors.As(err, &fe) || fe.File != "a" {
+			t.Fatalf("expected ErrIncomplete for a, got %v", err)
+		}
+	})
+
+	t.Run("input order", func(t *testing.T) {
+		in := make(chan ProcessedChunk[int], 2)
+		in <- ProcessedChunk[int]{File: "b", ChunkIndex: 0, Items: []int{1}, Summary: &FileSummary{}}
+		in <- ProcessedChunk[int]{File: "c", ChunkIndex: 0, Items: []int{2}, Summary: &FileSummary{}}
+		close(in)
+
+		_, err := CollectOrdered(context.Background(), in, WithInputOrder([]string{"a", "b", "c"}))
+		var fe *FileError
+		if !errors.Is(err, ErrIncomplete) || !errors.As(err, &fe) || fe.File != "a" {
+			t.Fatalf("expected ErrIncomplete for a, got %v", err)
+		}
+	})
+
+	t.Run("with other failures", func(t *testing.T) {
+		procErr := errors.New("bad chunk")
+		in := make(chan ProcessedChunk[int], 3)
+		in <- ProcessedChunk[int]{File: "a", ChunkIndex: 0, Err: procErr}
+		in <- ProcessedChunk[int]{File: "a", ChunkIndex: 1, Items: []int{1}, Summary: &FileSummary{}}
+		in <- ProcessedChunk[int]{File: "b", ChunkIndex: 1, Items: []int{2}, Summary: &FileSummary{}}
+		close(in)
+
+		results, err := CollectOrdered(context.Background(), in, WithFailurePolicy(ContinueOnError))
+		var report *FailureReport
+		if !errors.As(err, &report) || !errors.Is(err, procErr) || !errors.Is(err, ErrIncomplete) {
+			t.Fatalf("expected a report with both failures, got %v", err)
+		}
+		if got, want := report.Files(), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("failed files = %v, want %v", got, want)
+		}
+		if got, want := results["a"], []int{1}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("results = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("unsent file at the end", func(t *testing.T) {
+		in := make(chan ProcessedChunk[int], 1)
+		in <- ProcessedChunk[int]{File: "a", ChunkIndex: 0, Items: []int{1}, Summary: &FileSummary{}}
+		close(in)
+
+		results, err := CollectOrdered(context.Background(), in, WithInputOrder([]string{"a", "b"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := results["a"], []int{1}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("results = %v, want %v", got, want)
+		}
+	})
+}
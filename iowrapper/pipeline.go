@@ -1,9 +1,13 @@
 package iowrapper
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"sync"
+	"io"
+	"io/fs"
+	"time"
 )
 
 // FileJob represents a single file that needs to be processed.
@@ -15,6 +19,24 @@ type FileJob struct {
 type FileChunk struct {
 	File  string
 	Chunk BytesChunk
+	// Offset is the position of the chunk in the file after decompression.
+	Offset int64
+	// FirstLine is the 1-based number of the chunk's first line in the file.
+	FirstLine int64
+	// Summary is set on the last chunk of every file and nil otherwise.
+	Summary *FileSummary
+}
+
+// FileSummary describes a file once the chunk workers are done with it.
+type FileSummary struct {
+	// Started is when the worker picked up the file.
+	Started time.Time
+	// Chunks, Lines and Bytes count what was read from the file (after decompression).
+	Chunks int
+	Lines  int64
+	Bytes  int64
+	// Err is set when the file failed to open or read. The chunk carrying it has no data.
+	Err error
 }
 
 // ProcessedChunk carries the result of processing a chunk. Items must remain in the same order
@@ -22,15 +44,28 @@ type FileChunk struct {
 type ProcessedChunk[T any] struct {
 	File       string
 	ChunkIndex int
-	Items      []T
-	Err        error
+	// Offset, Bytes, FirstLine and Lines locate the input chunk the items were produced from.
+	Offset    int64
+	Bytes     int
+	FirstLine int64
+	Lines     int
+	Items     []T
+	Err       error
+	// LineErrors lists the lines that failed when the processor returned *LineErrors.
+	LineErrors []LineError
+	// Summary is copied from the FileChunk and marks the last chunk of a file.
+	Summary *FileSummary
 }
 
 // ChunkProcessorFunc transforms a FileChunk into zero or more domain items.
 type ChunkProcessorFunc[T any] func(FileChunk) ([]T, error)
 
 // StartFileProducer pushes the provided file list into a channel and closes it when done.
-func StartFileProducer(ctx context.Context, files []string) <-chan FileJob {
+// WithSchedule changes the order in which the files are sent.
+func StartFileProducer(ctx context.Context, files []string, opts ...StageOption) <-chan FileJob {
+	if o := newStageOptions(opts); o.schedule != nil {
+		files = o.schedule(files)
+	}
 	out := make(chan FileJob)
 	go func() {
 		defer close(out)
@@ -46,219 +81,398 @@ func StartFileProducer(ctx context.Context, files []string) <-chan FileJob {
 }
 
 // StartChunkWorkers spins up a worker pool that reads files, splits them into chunks and streams them.
-func StartChunkWorkers(ctx context.Context, workerCount int, chunkSize int, files <-chan FileJob) (<-chan FileChunk, <-chan error) {
+//
+// Every file that fails to open or read is reported on the error channel as a *FileError; no error is
+// dropped and a failing worker moves on to the next file. With the FailFast policy (the default) the
+// first failure also stops all workers. Cancellation of ctx is not reported as a file error. The error
+// channel is closed after the chunk channel and must be drained until it is closed, also after an
+// error or a cancellation: errors are queued rather than dropped, and the goroutine delivering them
+// only exits once every one has been received. CollectErrors turns the channel into a single
+// *FailureReport.
+func StartChunkWorkers(ctx context.Context, workerCount int, chunkSize int, files <-chan FileJob, opts ...StageOption) (<-chan FileChunk, <-chan error) {
+	o := newStageOptions(opts)
+	if o.sample != nil && o.checkpoint != nil {
+		out := make(chan FileChunk)
+		errCh := make(chan error, 1)
+		errCh <- errSampledCheckpoint
+		close(out)
+		close(errCh)
+		return out, errCh
+	}
+	if o.sample != nil && o.sample.Reservoir > 0 && o.sample.ReservoirOverall {
+		o.overall = newOverallReservoir(*o.sample)
+	}
 	out := make(chan FileChunk)
-	errCh := make(chan error, workerCount)
-
-	var wg sync.WaitGroup
-	wg.Add(workerCount)
-
-	for i := 0; i < workerCount; i++ {
-		go func() {
-			defer wg.Done()
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case job, ok := <-files:
-					if !ok {
-						return
-					}
-					if err := streamFileChunks(ctx, job.Path, chunkSize, out); err != nil {
-						select {
-						case errCh <- err:
-						default:
-						}
-						return
-					}
+	errIn := make(chan error)
+	errCh := make(chan error)
+	go relayErrors(errIn, errCh)
+
+	workCtx, cancel := context.WithCancel(ctx)
+
+	pool := newWorkerPool(func(pool *workerPool) bool {
+		for {
+			if pool.retire() {
+				return true
+			}
+			select {
+			case <-workCtx.Done():
+				return false
+			case job, ok := <-files:
+				if !ok || workCtx.Err() != nil {
+					return false
+				}
+				if o.checkpoint != nil && o.checkpoint.done(o.fsys, job.Path) {
+					continue
+				}
+				err := streamFileChunks(workCtx, job.Path, chunkSize, &o, out)
+				if err == nil || (workCtx.Err() != nil && isContextErr(err)) {
+					continue
+				}
+				errIn <- &FileError{File: job.Path, Err: err}
+				if o.policy == FailFast {
+					cancel()
 				}
 			}
-		}()
+		}
+	})
+	if o.autoscale != nil {
+		o.autoscale.attachReaders(workCtx, pool, workerCount)
+	} else {
+		pool.start(workerCount)
 	}
 
 	go func() {
-		wg.Wait()
+		pool.wait()
+		if o.overall != nil && workCtx.Err() == nil {
+			finishSample(workCtx, &o, o.overall, out)
+		}
+		cancel()
 		close(out)
-		close(errCh)
+		close(errIn)
 	}()
 
 	return out, errCh
 }
 
+// StartChunkWorkersFS is StartChunkWorkers reading the files from fsys.
+func StartChunkWorkersFS(ctx context.Context, fsys fs.FS, workerCount int, chunkSize int, files <-chan FileJob, opts ...StageOption) (<-chan FileChunk, <-chan error) {
+	return StartChunkWorkers(ctx, workerCount, chunkSize, files, append(opts, WithFS(fsys))...)
+}
+
 // streamFileChunks reads the file at path, splits it into chunks of chunkSize, and sends them to out channel.
-func streamFileChunks(ctx context.Context, path string, chunkSize int, out chan<- FileChunk) error {
+// The last chunk carries the file's FileSummary; a file that fails after it was picked up gets a final
+// data-less chunk whose summary holds the error. It returns only after the splitter goroutine has exited
+// and the reader has been closed.
+func streamFileChunks(ctx context.Context, path string, chunkSize int, o *stageOptions, out chan<- FileChunk) error {
+	s := &fileStream{
+		ctx:       ctx,
+		fsys:      o.fsys,
+		path:      path,
+		budget:    o.budget,
+		metrics:   o.metrics,
+		autoscale: o.autoscale,
+		progress:  o.progress,
+		sample:    o.sample,
+		overall:   o.overall,
+		out:       out,
+		summary:   FileSummary{Started: time.Now()},
+	}
+	s.base, s.offset, s.lines = o.checkpoint.start(o.fsys, path)
+	split := o.splitter
+	if a := o.autoscale; a != nil {
+		chunkSize = a.currentChunkSize(chunkSize)
+		if split == nil {
+			split = func(r io.Reader, _ int, ch chan<- BytesChunk) {
+				splitAtNewlines(r, func() int { return a.currentChunkSize(chunkSize) }, ch)
+			}
+		}
+	}
+	if split == nil {
+		split = SliceToBytesChunks2
+	}
+	err := s.stream(chunkSize, split)
+	if err == nil {
+		o.metrics.fileRead()
+	}
+	if err == nil || ctx.Err() == nil {
+		o.progress.fileDone(err)
+	}
+	if err != nil && ctx.Err() == nil {
+		summary := s.summary
+		summary.Err = err
+		_ = s.send(BytesChunk{}, &summary)
+	}
+	return err
+}
+
+// fileStream sends the chunks of a single file downstream and accumulates its FileSummary.
+// Chunks are renumbered from base and their offsets counted from offset, which are non-zero
+// when a checkpointed file resumes.
+type fileStream struct {
+	ctx       context.Context
+	fsys      fs.FS
+	path      string
+	budget    *ReorderBudget
+	metrics   *Metrics
+	autoscale *Autoscaler
+	progress  *Progress
+	sample    *Sampling
+	overall   *overallReservoir
+	out       chan<- FileChunk
+	summary   FileSummary
+	base      int
+	offset    int64
+	lines     int64
+	sent      int
+}
+
+func (s *fileStream) stream(chunkSize int, split SplitterFunc) error {
 	bufferSize := chunkSize
 	if bufferSize <= 0 {
 		bufferSize = 64 * 1024
 	}
 
-	reader, closer, err := Reader(path, bufferSize)
+	reader, closer, seeked, err := openReaderAt(s.fsys, s.path, bufferSize, s.offset, s.progress.reader())
 	if err != nil {
-		return fmt.Errorf("open reader for %s: %w", path, err)
+		return fmt.Errorf("open reader: %w", err)
 	}
 	defer closer.Close()
+	if seeked {
+		s.progress.resumed(s.offset)
+	}
 
+	// Sampling may stop reading before the end of the file.
+	readCtx, stop := context.WithCancel(s.ctx)
+	defer stop()
+	src := &contextReader{ctx: readCtx, r: reader}
 	ch := make(chan BytesChunk)
 	go func() {
-		SliceToBytesChunks2(reader, chunkSize, ch)
+		split(src, chunkSize, ch)
 		close(ch)
 	}()
+	// Unblock the splitter and wait for it before the reader is closed. Once ctx is done the
+	// contextReader fails every read, so the splitter stops after at most one more chunk.
+	defer func() {
+		for range ch {
+		}
+	}()
+
+	if s.sample != nil {
+		return s.streamSampled(src, ch, stop)
+	}
 
+	// Hold one chunk back so that the last one can carry the summary.
+	var held *BytesChunk
+	waited := time.Now()
 	for chunk := range ch {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case out <- FileChunk{File: path, Chunk: chunk}:
+		lines := countLines(chunk.Data)
+		s.metrics.chunkRead(len(chunk.Data), lines, time.Since(waited))
+		s.summary.Chunks++
+		s.summary.Bytes += int64(len(chunk.Data))
+		s.summary.Lines += lines
+		if held != nil {
+			if err := s.send(*held, nil); err != nil {
+				return err
+			}
 		}
+		held = &chunk
+		waited = time.Now()
 	}
-	return nil
-}
-
-// StartChunkProcessors consumes file chunks and hands them to lineProcessor. The processor function should
-// convert each chunk into a slice of domain items. The resulting channel is closed when processing is complete.
-func StartChunkProcessors[T any](ctx context.Context, workerCount int, chunks <-chan FileChunk, lineProcessor ChunkProcessorFunc[T]) <-chan ProcessedChunk[T] {
-	out := make(chan ProcessedChunk[T])
-
-	var wg sync.WaitGroup
-	wg.Add(workerCount)
-
-	for i := 0; i < workerCount; i++ {
-		go func() {
-			defer wg.Done()
-			for chunk := range chunks {
-				items, err := lineProcessor(chunk)
-				select {
-				case <-ctx.Done():
-					return
-				case out <- ProcessedChunk[T]{
-					File:       chunk.File,
-					ChunkIndex: chunk.Chunk.Index,
-					Items:      items,
-					Err:        err,
-				}:
-				}
+	if src.err != nil {
+		if held != nil {
+			if err := s.send(*held, nil); err != nil {
+				return err
 			}
-		}()
+		}
+		return fmt.Errorf("read: %w", src.err)
 	}
 
-	go func() {
-		wg.Wait()
-		close(out)
-	}()
-
-	return out
+	summary := s.summary
+	if held == nil {
+		// Empty files still get a chunk so that downstream stages learn about them.
+		return s.send(BytesChunk{}, &summary)
+	}
+	return s.send(*held, &summary)
 }
 
-// CollectOrdered drains processed chunk results, ensuring chunks are appended in order per file.
-func CollectOrdered[T any](ctx context.Context, in <-chan ProcessedChunk[T]) (map[string][]T, error) {
-	results := make(map[string][]T)
-	nextIndex := make(map[string]int)
-	buffers := make(map[string]map[int][]T)
-
-	for {
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case res, ok := <-in:
-			if !ok {
-				return results, nil
-			}
-			if res.Err != nil {
-				return nil, res.Err
-			}
-
-			if res.Items == nil {
-				continue
-			}
-
-			if res.ChunkIndex == nextIndex[res.File] {
-				results[res.File] = append(results[res.File], res.Items...)
-				nextIndex[res.File]++
-				drainBuffer(res.File, results, nextIndex, buffers)
-				continue
-			}
-
-			if _, exists := buffers[res.File]; !exists {
-				buffers[res.File] = make(map[int][]T)
-			}
-			buffers[res.File][res.ChunkIndex] = res.Items
+// send numbers chunk after the chunks sent before it and passes it downstream.
+func (s *fileStream) send(chunk BytesChunk, summary *FileSummary) error {
+	chunk.Index = s.base + s.sent
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	if s.budget != nil {
+		if err := s.budget.acquire(s.ctx, s.path, len(chunk.Data)); err != nil {
+			return err
+		}
+	}
+	s.metrics.queued(1)
+	waited := time.Now()
+	defer func() { s.autoscale.observeBlocked(time.Since(waited)) }()
+	select {
+	case <-s.ctx.Done():
+		s.metrics.queued(-1)
+		if s.budget != nil {
+			s.budget.release(s.path, len(chunk.Data))
 		}
+		return s.ctx.Err()
+	case s.out <- FileChunk{File: s.path, Chunk: chunk, Offset: s.offset, FirstLine: s.lines + 1, Summary: summary}:
+		s.metrics.queued(-1)
+		s.metrics.sent()
+		s.sent++
+		s.offset += int64(len(chunk.Data))
+		s.lines += countLines(chunk.Data)
+		return nil
 	}
 }
 
-func drainBuffer[T any](file string, results map[string][]T, nextIndex map[string]int, buffers map[string]map[int][]T) {
-	for {
-		if pendingChunks, ok := buffers[file]; ok {
-			if entry, ok := pendingChunks[nextIndex[file]]; ok {
-				results[file] = append(results[file], entry...)
-				delete(pendingChunks, nextIndex[file])
-				nextIndex[file]++
-				continue
-			}
-			if len(pendingChunks) == 0 {
-				delete(buffers, file)
-			}
-		}
-		return
+// countLines returns the number of lines in data, counting a final line without a trailing newline.
+func countLines(data []byte) int64 {
+	n := int64(bytes.Count(data, []byte{'\n'}))
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		n++
 	}
+	return n
 }
 
-// StreamOrdered invokes sink(file, items) for each chunk in order. It keeps only out-of-order chunks buffered.
-func StreamOrdered[T any](ctx context.Context, in <-chan ProcessedChunk[T], sink func(string, []T) error) error {
-	nextIndex := make(map[string]int)
-	buffers := make(map[string]map[int][]T)
+// contextReader stops reading once ctx is done and remembers the first read error, which the
+// splitters would otherwise swallow. It must only be used from a single goroutine.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+	err error
+}
 
-	flush := func(file string) error {
-		for {
-			if pending, ok := buffers[file]; ok {
-				items, found := pending[nextIndex[file]]
-				if !found {
-					if len(pending) == 0 {
-						delete(buffers, file)
-					}
-					return nil
-				}
-				if err := sink(file, items); err != nil {
-					return err
-				}
-				delete(pending, nextIndex[file])
-				nextIndex[file]++
-				continue
-			}
-			return nil
-		}
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		c.err = err
+		return 0, err
+	}
+	n, err := c.r.Read(p)
+	if err != nil && err != io.EOF && c.err == nil {
+		c.err = err
 	}
+	return n, err
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case res, ok := <-in:
-			if !ok {
-				return nil
+// StartChunkProcessors consumes file chunks and hands them to lineProcessor. The processor function should
+// convert each chunk into a slice of domain items. The resulting channel is closed when processing is complete.
+// Once ctx is done the workers stop picking up chunks and exit without waiting for the input to close.
+//
+// A panic in lineProcessor is recovered and reported as a *PanicError on the chunk. WithRetry retries
+// failing chunks (but not panics). With WithDeadLetter, chunks that still fail are written to the
+// dead-letter file and passed on as empty results, so the rest of the run is unaffected.
+func StartChunkProcessors[T any](ctx context.Context, workerCount int, chunks <-chan FileChunk, lineProcessor ChunkProcessorFunc[T], opts ...StageOption) <-chan ProcessedChunk[T] {
+	o := newStageOptions(opts)
+	out := make(chan ProcessedChunk[T])
+
+	pool := newWorkerPool(func(pool *workerPool) bool {
+		for {
+			if pool.retire() {
+				return true
 			}
-			if res.Err != nil {
-				return res.Err
+			var chunk FileChunk
+			waited := time.Now()
+			select {
+			case <-ctx.Done():
+				return false
+			case c, ok := <-chunks:
+				if !ok {
+					return false
+				}
+				chunk = c
 			}
-			if res.Items == nil {
-				continue
+			o.autoscale.observeStarved(time.Since(waited))
+			if ctx.Err() != nil {
+				o.metrics.done()
+				return false
 			}
 
-			if res.ChunkIndex == nextIndex[res.File] {
-				if err := sink(res.File, res.Items); err != nil {
-					return err
+			// Data-less chunks only mark the end of a file; there is nothing to process.
+			var items []T
+			var err error
+			var lineErrs *LineErrors
+			if len(chunk.Chunk.Data) > 0 {
+				started := time.Now()
+				items, err = retryChunk(ctx, o.retry, chunk, lineProcessor)
+				took := time.Since(started)
+				// Failed lines leave a partial result that flows on like any other.
+				if errors.As(err, &lineErrs) {
+					err = nil
+				} else {
+					lineErrs = nil
 				}
-				nextIndex[res.File]++
-				if err := flush(res.File); err != nil {
-					return err
+				o.metrics.processed(took, err)
+				o.autoscale.observeProcessing(took)
+			}
+			if err != nil && o.deadLetter != nil && ctx.Err() == nil {
+				if dlErr := o.deadLetter.add(chunk, err); dlErr != nil {
+					err = fmt.Errorf("write dead letter: %w (processing error: %v)", dlErr, err)
+				} else {
+					items, err = nil, nil
 				}
-				continue
 			}
-
-			if _, ok := buffers[res.File]; !ok {
-				buffers[res.File] = make(map[int][]T)
+			o.metrics.handedOff(1)
+			select {
+			case <-ctx.Done():
+				o.metrics.handedOff(-1)
+				o.metrics.done()
+				return false
+			case out <- ProcessedChunk[T]{
+				File:       chunk.File,
+				ChunkIndex: chunk.Chunk.Index,
+				Offset:     chunk.Offset,
+				Bytes:      len(chunk.Chunk.Data),
+				FirstLine:  chunk.FirstLine,
+				Lines:      int(countLines(chunk.Chunk.Data)),
+				Items:      items,
+				Err:        err,
+				Summary:    chunk.Summary,
+				LineErrors: lineErrs.list(),
+			}:
+				o.metrics.handedOff(-1)
+				o.metrics.done()
 			}
-			buffers[res.File][res.ChunkIndex] = res.Items
 		}
+	})
+	if o.autoscale != nil {
+		o.autoscale.attachProcessors(ctx, pool, workerCount)
+	} else {
+		pool.start(workerCount)
 	}
+
+	go func() {
+		pool.wait()
+		close(out)
+	}()
+
+	return out
+}
+
+// CollectOrdered drains processed chunk results, ensuring chunks are appended in order per file.
+// When it returns early, the caller must cancel ctx so that the upstream stages exit.
+//
+// Under SkipFile and ContinueOnError, failed chunks do not stop the run: the error is then a
+// *FailureReport and the results of every file that was collected are returned along with it.
+func CollectOrdered[T any](ctx context.Context, in <-chan ProcessedChunk[T], opts ...StageOption) (map[string][]T, error) {
+	results := make(map[string][]T)
+	sink := func(file string, items []T) error {
+		results[file] = append(results[file], items...)
+		return nil
+	}
+	if err := newOrderedCollector(sink, opts).run(ctx, in); err != nil {
+		var report *FailureReport
+		if errors.As(err, &report) {
+			return results, err
+		}
+		return nil, err
+	}
+	return results, nil
+}
+
+// StreamOrdered invokes sink(file, items) for each chunk in order. It keeps only out-of-order chunks buffered;
+// pass WithReorderBudget to both StartChunkWorkers and StreamOrdered to bound that buffer.
+// When it returns early, the caller must cancel ctx so that the upstream stages exit.
+func StreamOrdered[T any](ctx context.Context, in <-chan ProcessedChunk[T], sink func(string, []T) error, opts ...StageOption) error {
+	return newOrderedCollector(sink, opts).run(ctx, in)
 }
@@ -4,14 +4,18 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 const (
@@ -98,7 +102,7 @@ type FakeLogRecord struct {
 }
 
 func parseChunkToFakeLogRecords(chunk FileChunk) ([]FakeLogRecord, error) {
-	base := filepath.Base(chunk.File)
+	base := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(chunk.File), ".gz"), ".zst")
 	lines := bytes.Split(chunk.Chunk.Data, []byte{'\n'})
 	records := make([]FakeLogRecord, 0, len(lines))
 
@@ -199,3 +203,162 @@ func TestPipelineEndToEnd(t *testing.T) {
 		}
 	}
 }
+
+func drainChunkWorkers(chunkCh <-chan FileChunk, errCh <-chan error) (map[string]int, error) {
+	lines := make(map[string]int)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for chunk := range chunkCh {
+			lines[chunk.File] += bytes.Count(chunk.Chunk.Data, []byte{'\n'})
+		}
+	}()
+	err := CollectErrors(errCh)
+	<-done
+	return lines, err
+}
+
+func TestStartChunkWorkersReportsEveryFailure(t *testing.T) {
+	dir, files, cleanup := createFakeLogFiles(t, 3, 200)
+	defer cleanup()
+
+	var sources []string
+	var missing []string
+	for i := 0; i < 10; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("missing_%02d.log", i))
+		missing = append(missing, path)
+		sources = append(sources, path)
+	}
+	sources = append(sources, files...)
+
+	for _, policy := range []FailurePolicy{SkipFile, ContinueOnError} {
+		t.Run(policy.String(), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			fileCh := StartFileProducer(ctx, sources)
+			chunkCh, errCh := StartChunkWorkers(ctx, 1, 1024, fileCh, WithFailurePolicy(policy))
+			lines, err := drainChunkWorkers(chunkCh, errCh)
+
+			var report *FailureReport
+			if !errors.As(err, &report) {
+				t.Fatalf("expected *FailureReport, got %v", err)
+			}
+			if got := report.Files(); !reflect.DeepEqual(got, missing) {
+				t.Fatalf("failed files = %v, want %v", got, missing)
+			}
+			for _, path := range files {
+				if lines[path] != 200 {
+					t.Fatalf("file %s: expected 200 lines after failures, got %d", path, lines[path])
+				}
+			}
+		})
+	}
+}
+
+func TestStartChunkWorkersFailFast(t *testing.T) {
+	dir, files, cleanup := createFakeLogFiles(t, 3, 200)
+	defer cleanup()
+
+	missing := filepath.Join(dir, "missing.log")
+	sources := append([]string{missing}, files...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fileCh := StartFileProducer(ctx, sources)
+	chunkCh, errCh := StartChunkWorkers(ctx, 1, 1024, fileCh)
+	lines, err := drainChunkWorkers(chunkCh, errCh)
+
+	var report *FailureReport
+	if !errors.As(err, &report) {
+		t.Fatalf("expected *FailureReport, got %v", err)
+	}
+	if got := report.Files(); len(got) != 1 || got[0] != missing {
+		t.Fatalf("failed files = %v, want [%s]", got, missing)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist in report, got %v", err)
+	}
+	for _, path := range files {
+		if _, ok := lines[path]; ok {
+			t.Fatalf("expected no chunks after fail-fast, got %v", lines)
+		}
+	}
+}
+
+// waitForGoroutines polls until the number of running goroutines drops to at most want.
+func waitForGoroutines(t *testing.T, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := runtime.NumGoroutine()
+		if got <= want {
+			return
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			n := runtime.Stack(buf, true)
+			t.Fatalf("goroutines leaked: %d running, want <= %d\n%s", got, want, buf[:n])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStagesExitOnCancelMidStream(t *testing.T) {
+	_, files, cleanup := createFakeLogFiles(t, 4, 20000)
+	defer cleanup()
+
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fileCh := StartFileProducer(ctx, files)
+	chunkCh, errCh := StartChunkWorkers(ctx, 2, 4*1024, fileCh)
+	processedCh := StartChunkProcessors[FakeLogRecord](ctx, 4, chunkCh, parseChunkToFakeLogRecords)
+
+	// Consume a few results, then walk away from every channel and cancel.
+	for i := 0; i < 3; i++ {
+		if _, ok := <-processedCh; !ok {
+			t.Fatal("processed channel closed early")
+		}
+	}
+	cancel()
+
+	waitForGoroutines(t, before)
+
+	if _, ok := <-errCh; ok {
+		t.Fatal("expected no reader errors on cancellation")
+	}
+}
+
+func TestStreamOrderedCancelMidStream(t *testing.T) {
+	_, files, cleanup := createFakeLogFiles(t, 4, 20000)
+	defer cleanup()
+
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fileCh := StartFileProducer(ctx, files)
+	chunkCh, errCh := StartChunkWorkers(ctx, 2, 4*1024, fileCh)
+	processedCh := StartChunkProcessors[FakeLogRecord](ctx, 4, chunkCh, parseChunkToFakeLogRecords)
+
+	calls := 0
+	err := StreamOrdered(ctx, processedCh, func(string, []FakeLogRecord) error {
+		calls++
+		if calls == 5 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	waitForGoroutines(t, before)
+
+	if err := CollectErrors(errCh); err != nil {
+		t.Fatalf("expected no reader errors on cancellation, got %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+package iowrapper
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mihudec/goutils/logging"
+	"go.uber.org/zap"
+)
+
+// DefaultProgressInterval is the time between progress updates.
+const DefaultProgressInterval = time.Second
+
+// ProgressUpdate describes how far a run has got. Bytes are counted before decompression, so they
+// can be compared with the file sizes on disk.
+type ProgressUpdate struct {
+	Files       int
+	FilesDone   int
+	FilesFailed int
+	// Bytes is the number of input bytes consumed so far, TotalBytes the combined size of the files.
+	// Stdin and files that could not be stat'ed do not count towards TotalBytes.
+	Bytes      int64
+	TotalBytes int64
+	// Percent is Bytes as a percentage of TotalBytes, or 0 when the total is unknown.
+	Percent float64
+	// Rate is the average number of input bytes consumed per second.
+	Rate float64
+	// ETA is the estimated time left, or 0 when it cannot be estimated.
+	ETA     time.Duration
+	Elapsed time.Duration
+	// Done is set on the final update sent by Stop.
+	Done bool
+}
+
+// Progress tracks the input consumed by StartChunkWorkers against the total size of the files and
+// calls OnUpdate every Interval. Set Pipeline.Progress, or call Start with the file list, pass the
+// Progress to StartChunkWorkers with WithProgress and call Stop once the workers are done.
+// LogProgress and ProgressBar provide ready-made OnUpdate functions.
+type Progress struct {
+	// Interval is the time between updates. Defaults to DefaultProgressInterval.
+	Interval time.Duration
+	// OnUpdate receives the updates, from a single goroutine.
+	OnUpdate func(ProgressUpdate)
+
+	files       atomic.Int64
+	filesDone   atomic.Int64
+	filesFailed atomic.Int64
+	bytes       atomic.Int64
+	skipped     atomic.Int64
+	total       atomic.Int64
+	started     time.Time
+	fsys        fs.FS
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Start records the files of the run, adds up their sizes and starts the periodic updates.
+func (p *Progress) Start(files []string) {
+	p.start(nil, files)
+}
+
+// start is Start looking up the file sizes in fsys.
+func (p *Progress) start(fsys fs.FS, files []string) {
+	p.fsys = fsys
+	// A Progress may serve several runs; each one starts from zero.
+	p.files.Store(0)
+	p.filesDone.Store(0)
+	p.filesFailed.Store(0)
+	p.bytes.Store(0)
+	p.skipped.Store(0)
+	p.total.Store(0)
+	for _, file := range files {
+		p.add(file)
+	}
+	p.started = time.Now()
+	p.stop = make(chan struct{})
+
+	interval := p.Interval
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				if p.OnUpdate != nil {
+					p.OnUpdate(p.Snapshot())
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends the periodic updates and sends a final update with Done set.
+func (p *Progress) Stop() {
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	p.wg.Wait()
+	p.stop = nil
+	if p.OnUpdate != nil {
+		update := p.Snapshot()
+		update.Done = true
+		p.OnUpdate(update)
+	}
+}
+
+// Snapshot returns the current progress.
+func (p *Progress) Snapshot() ProgressUpdate {
+	u := ProgressUpdate{
+		Files:       int(p.files.Load()),
+		FilesDone:   int(p.filesDone.Load()),
+		FilesFailed: int(p.filesFailed.Load()),
+		Bytes:       p.bytes.Load(),
+		TotalBytes:  p.total.Load(),
+		Elapsed:     time.Since(p.started),
+	}
+	if u.TotalBytes > 0 {
+		u.Percent = min(100*float64(u.Bytes)/float64(u.TotalBytes), 100)
+	}
+	// Bytes skipped when resuming from a checkpoint were not read in this run.
+	if read := u.Bytes - p.skipped.Load(); read > 0 && u.Elapsed > 0 {
+		u.Rate = float64(read) / u.Elapsed.Seconds()
+		if left := u.TotalBytes - u.Bytes; left > 0 {
+			u.ETA = time.Duration(float64(left) / u.Rate * float64(time.Second)).Round(time.Second)
+		}
+	}
+	return u
+}
+
+// add counts file towards the run, for runs whose files are not known up front.
+func (p *Progress) add(file string) {
+	if p == nil {
+		return
+	}
+	p.files.Add(1)
+	if file == "-" {
+		return
+	}
+	if size, ok := fileSize(p.fsys, file); ok {
+		p.total.Add(size)
+	}
+}
+
+// wrap counts the bytes read through r.
+func (p *Progress) wrap(r io.Reader) io.Reader {
+	return &countingReader{r: r, n: &p.bytes}
+}
+
+// reader returns the wrapper passed to openReaderAt, or nil when p is nil.
+func (p *Progress) reader() func(io.Reader) io.Reader {
+	if p == nil {
+		return nil
+	}
+	return p.wrap
+}
+
+// resumed accounts for the bytes of a plain file skipped by seeking to a checkpoint.
+func (p *Progress) resumed(n int64) {
+	if p != nil {
+		p.bytes.Add(n)
+		p.skipped.Add(n)
+	}
+}
+
+func (p *Progress) fileDone(err error) {
+	if p == nil {
+		return
+	}
+	p.filesDone.Add(1)
+	if err != nil {
+		p.filesFailed.Add(1)
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// LogProgress returns an OnUpdate function that logs every update at info level. A nil logger
+// uses logging.Logger.
+func LogProgress(logger *zap.Logger) func(ProgressUpdate) {
+	return func(u ProgressUpdate) {
+		l := logger
+		if l == nil {
+			l = logging.Logger
+		}
+		if l == nil {
+			return
+		}
+		msg := "progress"
+		if u.Done {
+			msg = "progress complete"
+		}
+		l.Info(msg,
+			zap.Float64("percent", u.Percent),
+			zap.Int64("bytes", u.Bytes),
+			zap.Int64("total_bytes", u.TotalBytes),
+			zap.Float64("bytes_per_second", u.Rate),
+			zap.Duration("eta", u.ETA),
+			zap.Duration("elapsed", u.Elapsed),
+			zap.Int("files_done", u.FilesDone),
+			zap.Int("files_failed", u.FilesFailed),
+			zap.Int("files", u.Files),
+		)
+	}
+}
+
+// ProgressBar returns an OnUpdate function that redraws a single-line progress bar on w and ends
+// the line on the final update. w should be a terminal.
+func ProgressBar(w io.Writer) func(ProgressUpdate) {
+	const width = 30
+	return func(u ProgressUpdate) {
+		filled := int(u.Percent / 100 * width)
+		bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+		if filled > 0 && filled < width {
+			bar = bar[:filled-1] + ">" + bar[filled:]
+		}
+		eta := "--"
+		if u.ETA > 0 {
+			eta = u.ETA.String()
+		}
+		line := fmt.Sprintf("\r[%s] %5.1f%% %s/%s %s/s ETA %s %d/%d files",
+			bar, u.Percent, formatBytes(float64(u.Bytes)), formatBytes(float64(u.TotalBytes)), formatBytes(u.Rate), eta, u.FilesDone, u.Files)
+		if u.Done {
+			line += "\n"
+		} else {
+			line += "\033[K"
+		}
+		_, _ = io.WriteString(w, line)
+	}
+}
+
+// StderrProgressBar returns ProgressBar(os.Stderr) when stderr is a terminal and a no-op otherwise,
+// so that redirected output is not filled with redraws.
+func StderrProgressBar() func(ProgressUpdate) {
+	if info, err := os.Stderr.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return ProgressBar(os.Stderr)
+	}
+	return func(ProgressUpdate) {}
+}
+
+func formatBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	suffixes := "KMGTPE"
+	i := 0
+	for n /= unit; n >= unit && i < len(suffixes)-1; n /= unit {
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", n, suffixes[i])
+}
@@ -0,0 +1,172 @@
+package iowrapper
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestPipelineProgress(t *testing.T) {
+	dir, files, cleanup := createFakeLogFiles(t, 3, 4000)
+	defer cleanup()
+
+	var sources []string
+	var total int64
+	for _, path := range files {
+		gz := gzipFile(t, path)
+		info, err := os.Stat(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += info.Size()
+		sources = append(sources, gz)
+	}
+	missing := filepath.Join(dir, "missing.log")
+
+	var mu sync.Mutex
+	var updates []ProgressUpdate
+	progress := &Progress{
+		Interval: 5 * time.Millisecond,
+		OnUpdate: func(u ProgressUpdate) {
+			mu.Lock()
+			updates = append(updates, u)
+			mu.Unlock()
+		},
+	}
+	p := &Pipeline[FakeLogRecord]{
+		Sources:       append(sources, missing),
+		ChunkSize:     4 * 1024,
+		FailurePolicy: ContinueOnError,
+		Processor: func(chunk FileChunk) ([]FakeLogRecord, error) {
+			time.Sleep(time.Millisecond)
+			return parseChunkToFakeLogRecords(chunk)
+		},
+		Sink:     func(string, []FakeLogRecord) error { return nil },
+		Progress: progress,
+	}
+	if err := p.Run(context.Background()); err == nil {
+		t.Fatal("expected the missing file to fail")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(updates) < 2 {
+		t.Fatalf("expected periodic updates, got %d", len(updates))
+	}
+	final := updates[len(updates)-1]
+	if !final.Done || final.Files != 4 || final.FilesDone != 4 || final.FilesFailed != 1 {
+		t.Fatalf("unexpected final update %+v", final)
+	}
+	if final.TotalBytes != total || final.Bytes != total || final.Percent != 100 {
+		t.Fatalf("final update %+v, want %d of %d compressed bytes", final, total, total)
+	}
+	for i, u := range updates[:len(updates)-1] {
+		if u.Done {
+			t.Fatalf("update %d marked done early", i)
+		}
+		if i > 0 && u.Bytes < updates[i-1].Bytes {
+			t.Fatalf("progress went backwards: %d then %d", updates[i-1].Bytes, u.Bytes)
+		}
+	}
+}
+
+func TestProgressReusedAcrossRuns(t *testing.T) {
+	_, files, cleanup := createFakeLogFiles(t, 2, 1000)
+	defer cleanup()
+
+	var final []ProgressUpdate
+	progress := &Progress{
+		Interval: time.Hour,
+		OnUpdate: func(u ProgressUpdate) {
+			if u.Done {
+				final = append(final, u)
+			}
+		},
+	}
+	p := &Pipeline[FakeLogRecord]{
+		Sources:   files,
+		Processor: parseChunkToFakeLogRecords,
+		Sink:      func(string, []FakeLogRecord) error { return nil },
+		Progress:  progress,
+	}
+	for i := 0; i < 2; i++ {
+		if err := p.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(final) != 2 {
+		t.Fatalf("expected 2 final updates, got %d", len(final))
+	}
+	first, second := final[0], final[1]
+	if second.Files != first.Files || second.FilesDone != first.FilesDone || second.FilesFailed != first.FilesFailed ||
+		second.Bytes != first.Bytes || second.TotalBytes != first.TotalBytes || second.Percent != 100 {
+		t.Fatalf("second run reported %+v, first %+v", second, first)
+	}
+}
+
+func TestProgressSnapshotETA(t *testing.T) {
+	var p Progress
+	p.started = time.Now().Add(-10 * time.Second)
+	p.total.Store(4000)
+	p.bytes.Store(1000)
+
+	u := p.Snapshot()
+	if u.Percent != 25 {
+		t.Fatalf("percent = %v, want 25", u.Percent)
+	}
+	if u.Rate < 99 || u.Rate > 101 {
+		t.Fatalf("rate = %v, want about 100 B/s", u.Rate)
+	}
+	if u.ETA < 29*time.Second || u.ETA > 31*time.Second {
+		t.Fatalf("eta = %v, want about 30s", u.ETA)
+	}
+
+	// Bytes skipped on resume count towards the percentage but not the rate.
+	p.resumed(1000)
+	if u := p.Snapshot(); u.Percent != 50 || u.Rate > 101 {
+		t.Fatalf("after resume: %+v", u)
+	}
+}
+
+func TestProgressReporters(t *testing.T) {
+	u := ProgressUpdate{
+		Files:      4,
+		FilesDone:  1,
+		Bytes:      3 << 20,
+		TotalBytes: 6 << 20,
+		Percent:    50,
+		Rate:       1 << 20,
+		ETA:        3 * time.Second,
+	}
+
+	var buf bytes.Buffer
+	bar := ProgressBar(&buf)
+	bar(u)
+	if got := buf.String(); !strings.HasPrefix(got, "\r[==============>               ]  50.0% 3.0 MiB/6.0 MiB 1.0 MiB/s ETA 3s 1/4 files") {
+		t.Fatalf("unexpected bar %q", got)
+	}
+	u.Done = true
+	bar(u)
+	if !strings.HasSuffix(buf.String(), "\n") {
+		t.Fatal("final update does not end the line")
+	}
+
+	core, logs := observer.New(zap.InfoLevel)
+	LogProgress(zap.New(core))(u)
+	entries := logs.All()
+	if len(entries) != 1 || entries[0].Message != "progress complete" {
+		t.Fatalf("unexpected log entries %+v", entries)
+	}
+	if fields := entries[0].ContextMap(); fields["percent"] != 50.0 || fields["files_done"] != int64(1) {
+		t.Fatalf("unexpected fields %v", fields)
+	}
+}
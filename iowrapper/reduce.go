@@ -0,0 +1,402 @@
+package iowrapper
+
+import (
+	"cmp"
+	"container/heap"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// KeyValue is a reduced key with its accumulator.
+type KeyValue[K cmp.Ordered, A any] struct {
+	Key   K
+	Value A
+}
+
+// Reducer aggregates pipeline items by key, map-reduce style. Each worker combines the items it
+// receives into its own map; the maps are merged at the end and emitted sorted by key. When the
+// keys held in memory exceed MaxKeys, or their approximate size exceeds MemoryLimit, a worker sorts
+// its map and spills it to a compressed temporary file, and the spilled runs are merged back in
+// with a k-way merge of at most FanIn files at a time. Spilling encodes keys and accumulators with
+// encoding/gob, so A must be gob-encodable.
+type Reducer[T any, K cmp.Ordered, A any] struct {
+	// Key extracts the key of an item. Required.
+	Key func(T) K
+	// Add folds an item into an accumulator, starting from the zero value of A. Required.
+	Add func(acc A, item T) A
+	// Merge combines two accumulators of the same key. Required.
+	Merge func(a, b A) A
+	// Workers is the number of combiners. Defaults to runtime.NumCPU().
+	Workers int
+	// MaxKeys caps the keys held in memory across all combiners. Zero means no limit.
+	MaxKeys int
+	// MemoryLimit caps the memory held by keys and accumulators across all combiners, in bytes, as
+	// estimated by Size. Zero means no limit.
+	MemoryLimit int64
+	// Size estimates the memory of a key with its accumulator. Accumulators that grow, like slices
+	// or sets, need it to be bounded by MemoryLimit. Defaults to a fixed cost per key plus the length
+	// of string keys, which leaves the accumulators themselves unaccounted for.
+	Size func(key K, acc A) int64
+	// TempDir is where spill files are created. Defaults to os.TempDir().
+	TempDir string
+	// FanIn is the number of spill files merged at once. With more spill files than that, groups of
+	// them are first merged into larger ones. Defaults to DefaultSortFanIn.
+	FanIn int
+}
+
+// Run consumes in until it is closed and calls emit for every key in ascending order. A chunk error
+// stops the reduction and is returned; the caller must then cancel ctx so that the upstream stages
+// exit. Spill files are removed before Run returns.
+func (r *Reducer[T, K, A]) Run(ctx context.Context, in <-chan ProcessedChunk[T], emit func(K, A) error) error {
+	if r.Key == nil || r.Add == nil || r.Merge == nil {
+		return errors.New("iowrapper: reducer needs Key, Add and Merge")
+	}
+
+	workers := r.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	limit := 0
+	if r.MaxKeys > 0 {
+		limit = max(r.MaxKeys/workers, 1)
+	}
+	var memLimit int64
+	if r.MemoryLimit > 0 {
+		memLimit = max(r.MemoryLimit/int64(workers), 1)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		spills   []string
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+	defer func() {
+		for _, path := range spills {
+			_ = os.Remove(path)
+		}
+	}()
+
+	combined := make([]map[K]A, workers)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			acc := make(map[K]A)
+			var size int64
+			defer func() { combined[i] = acc }()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case res, ok := <-in:
+					if !ok {
+						return
+					}
+					if res.Err != nil {
+						fail(res.Err)
+						return
+					}
+					for _, item := range res.Items {
+						key := r.Key(item)
+						prev, ok := acc[key]
+						if memLimit > 0 && ok {
+							size -= r.entrySize(key, prev)
+						}
+						next := r.Add(prev, item)
+						acc[key] = next
+						if memLimit > 0 {
+							size += r.entrySize(key, next)
+						}
+					}
+					if (limit > 0 && len(acc) > limit) || (memLimit > 0 && size > memLimit) {
+						path, err := r.spill(acc)
+						if path != "" {
+							mu.Lock()
+							spills = append(spills, path)
+							mu.Unlock()
+						}
+						if err != nil {
+							fail(err)
+							return
+						}
+						acc, size = make(map[K]A), 0
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	final := make(map[K]A)
+	for _, acc := range combined {
+		for key, value := range acc {
+			if prev, ok := final[key]; ok {
+				value = r.Merge(prev, value)
+			}
+			final[key] = value
+		}
+	}
+
+	for len(spills) > r.fanIn() {
+		var merged []string
+		for i := 0; i < len(spills); i += r.fanIn() {
+			group := spills[i:min(i+r.fanIn(), len(spills))]
+			path, err := r.mergeToSpill(ctx, group)
+			for j := range group {
+				_ = os.Remove(group[j])
+				group[j] = ""
+			}
+			if path != "" {
+				merged = append(merged, path)
+			}
+			if err != nil {
+				spills = append(spills, merged...)
+				return err
+			}
+		}
+		spills = merged
+	}
+	return r.merge(ctx, sortedPairs(final), spills, func(pair KeyValue[K, A]) error {
+		return emit(pair.Key, pair.Value)
+	})
+}
+
+func (r *Reducer[T, K, A]) fanIn() int {
+	if r.FanIn < 2 {
+		return DefaultSortFanIn
+	}
+	return r.FanIn
+}
+
+// reduceEntryOverhead approximates the memory a key costs in a combiner map beyond its contents.
+const reduceEntryOverhead = 64
+
+// entrySize returns the estimated memory of key with its accumulator.
+func (r *Reducer[T, K, A]) entrySize(key K, acc A) int64 {
+	if r.Size != nil {
+		return r.Size(key, acc)
+	}
+	size := int64(reduceEntryOverhead)
+	if s, ok := any(key).(string); ok {
+		size += int64(len(s))
+	}
+	return size
+}
+
+// Collect runs the reducer and returns every key with its accumulator, sorted by key.
+func (r *Reducer[T, K, A]) Collect(ctx context.Context, in <-chan ProcessedChunk[T]) ([]KeyValue[K, A], error) {
+	var out []KeyValue[K, A]
+	err := r.Run(ctx, in, func(key K, value A) error {
+		out = append(out, KeyValue[K, A]{Key: key, Value: value})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func sortedPairs[K cmp.Ordered, A any](m map[K]A) []KeyValue[K, A] {
+	pairs := make([]KeyValue[K, A], 0, len(m))
+	for key, value := range m {
+		pairs = append(pairs, KeyValue[K, A]{Key: key, Value: value})
+	}
+	slices.SortFunc(pairs, func(a, b KeyValue[K, A]) int { return cmp.Compare(a.Key, b.Key) })
+	return pairs
+}
+
+// spill writes acc sorted by key to a new temporary file and returns its path.
+func (r *Reducer[T, K, A]) spill(acc map[K]A) (string, error) {
+	return r.writeSpill(func(emit func(KeyValue[K, A]) error) error {
+		for _, pair := range sortedPairs(acc) {
+			if err := emit(pair); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// mergeToSpill merges the given spill files into a new one.
+func (r *Reducer[T, K, A]) mergeToSpill(ctx context.Context, paths []string) (string, error) {
+	return r.writeSpill(func(emit func(KeyValue[K, A]) error) error {
+		return r.merge(ctx, nil, paths, emit)
+	})
+}
+
+func (r *Reducer[T, K, A]) writeSpill(write func(emit func(KeyValue[K, A]) error) error) (string, error) {
+	f, err := os.CreateTemp(r.TempDir, "reduce-spill-*.gob.zst")
+	if err != nil {
+		return "", fmt.Errorf("create spill file: %w", err)
+	}
+	path := f.Name()
+
+	zw, err := zstd.NewWriter(f, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		f.Close()
+		return path, err
+	}
+	enc := gob.NewEncoder(zw)
+	err = write(func(pair KeyValue[K, A]) error {
+		if err := enc.Encode(&pair); err != nil {
+			return fmt.Errorf("write spill file: %w", err)
+		}
+		return nil
+	})
+	if cerr := zw.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("write spill file: %w", cerr)
+	}
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("write spill file: %w", cerr)
+	}
+	return path, err
+}
+
+// spillRun iterates over the pairs of one sorted run, either in memory or in a spill file.
+type spillRun[K cmp.Ordered, A any] struct {
+	head KeyValue[K, A]
+
+	mem  []KeyValue[K, A]
+	dec  *gob.Decoder
+	zr   *zstd.Decoder
+	file *os.File
+}
+
+func (s *spillRun[K, A]) next() (bool, error) {
+	if s.dec == nil {
+		if len(s.mem) == 0 {
+			return false, nil
+		}
+		s.head, s.mem = s.mem[0], s.mem[1:]
+		return true, nil
+	}
+	var pair KeyValue[K, A]
+	if err := s.dec.Decode(&pair); err != nil {
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		return false, fmt.Errorf("read spill file: %w", err)
+	}
+	s.head = pair
+	return true, nil
+}
+
+func (s *spillRun[K, A]) close() {
+	if s.zr != nil {
+		s.zr.Close()
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+}
+
+type runHeap[K cmp.Ordered, A any] []*spillRun[K, A]
+
+func (h runHeap[K, A]) Len() int           { return len(h) }
+func (h runHeap[K, A]) Less(i, j int) bool { return cmp.Less(h[i].head.Key, h[j].head.Key) }
+func (h runHeap[K, A]) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *runHeap[K, A]) Push(x any)        { *h = append(*h, x.(*spillRun[K, A])) }
+func (h *runHeap[K, A]) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// advance moves the smallest run to its next pair, dropping it when it is exhausted.
+func (h *runHeap[K, A]) advance() error {
+	ok, err := (*h)[0].next()
+	if err != nil {
+		return err
+	}
+	if ok {
+		heap.Fix(h, 0)
+	} else {
+		heap.Pop(h)
+	}
+	return nil
+}
+
+// merge performs a k-way merge of the in-memory run and the spill files, combining equal keys.
+func (r *Reducer[T, K, A]) merge(ctx context.Context, mem []KeyValue[K, A], spills []string, emit func(KeyValue[K, A]) error) error {
+	runs := []*spillRun[K, A]{{mem: mem}}
+	defer func() {
+		for _, run := range runs {
+			run.close()
+		}
+	}()
+	for _, path := range spills {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("open spill file: %w", err)
+		}
+		// One decoder goroutine per run: a merge holds up to FanIn of them at once.
+		zr, err := zstd.NewReader(f, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("open spill file: %w", err)
+		}
+		runs = append(runs, &spillRun[K, A]{dec: gob.NewDecoder(zr), zr: zr, file: f})
+	}
+
+	h := make(runHeap[K, A], 0, len(runs))
+	for _, run := range runs {
+		ok, err := run.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h = append(h, run)
+		}
+	}
+	heap.Init(&h)
+
+	for h.Len() > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		current := h[0].head
+		if err := h.advance(); err != nil {
+			return err
+		}
+		for h.Len() > 0 && h[0].head.Key == current.Key {
+			current.Value = r.Merge(current.Value, h[0].head.Value)
+			if err := h.advance(); err != nil {
+				return err
+			}
+		}
+		if err := emit(current); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package iowrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type domainHit struct {
+	Domain string
+	Bytes  int
+}
+
+type domainTotals struct {
+	Hits  int
+	Bytes int
+}
+
+func domainReducer(maxKeys int, tempDir string) *Reducer[domainHit, string, domainTotals] {
+	return &Reducer[domainHit, string, domainTotals]{
+		Key: func(h domainHit) string { return h.Domain },
+		Add: func(acc domainTotals, h domainHit) domainTotals {
+			return domainTotals{Hits: acc.Hits + 1, Bytes: acc.Bytes + h.Bytes}
+		},
+		Merge: func(a, b domainTotals) domainTotals {
+			return domainTotals{Hits: a.Hits + b.Hits, Bytes: a.Bytes + b.Bytes}
+		},
+		Workers: 4,
+		MaxKeys: maxKeys,
+		TempDir: tempDir,
+	}
+}
+
+func feedDomainHits(chunks, perChunk, distinct int) (<-chan ProcessedChunk[domainHit], map[string]domainTotals) {
+	want := make(map[string]domainTotals)
+	ch := make(chan ProcessedChunk[domainHit], chunks)
+	for c := 0; c < chunks; c++ {
+		items := make([]domainHit, 0, perChunk)
+		for i := 0; i < perChunk; i++ {
+			hit := domainHit{Domain: fmt.Sprintf("host%04d.example.com", (c*perChunk+i*7)%distinct), Bytes: i}
+			items = append(items, hit)
+			totals := want[hit.Domain]
+			want[hit.Domain] = domainTotals{Hits: totals.Hits + 1, Bytes: totals.Bytes + hit.Bytes}
+		}
+		ch <- ProcessedChunk[domainHit]{File: "hits.log", ChunkIndex: c, Items: items}
+	}
+	close(ch)
+	return ch, want
+}
+
+func TestReducerCollect(t *testing.T) {
+	for _, maxKeys := range []int{0, 40} {
+		t.Run(fmt.Sprintf("maxKeys=%d", maxKeys), func(t *testing.T) {
+			dir := t.TempDir()
+			in, want := feedDomainHits(200, 50, 1000)
+
+			got, err := domainReducer(maxKeys, dir).Collect(context.Background(), in)
+			if err != nil {
+				t.Fatalf("Collect returned error: %v", err)
+			}
+
+			if len(got) != len(want) {
+				t.Fatalf("expected %d keys, got %d", len(want), len(got))
+			}
+			if !slices.IsSortedFunc(got, func(a, b KeyValue[string, domainTotals]) int {
+				return strings.Compare(a.Key, b.Key)
+			}) {
+				t.Fatal("results are not sorted by key")
+			}
+			for _, kv := range got {
+				if kv.Value != want[kv.Key] {
+					t.Fatalf("%s: got %+v, want %+v", kv.Key, kv.Value, want[kv.Key])
+				}
+			}
+
+			left, err := filepath.Glob(filepath.Join(dir, "*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(left) != 0 {
+				t.Fatalf("spill files left behind: %v", left)
+			}
+		})
+	}
+}
+
+func TestReducerSpillsToDisk(t *testing.T) {
+	dir := t.TempDir()
+	in, _ := feedDomainHits(100, 50, 1000)
+
+	spilled := false
+	r := domainReducer(20, dir)
+	err := r.Run(context.Background(), in, func(string, domainTotals) error {
+		if !spilled {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				return err
+			}
+			spilled = len(entries) > 0
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !spilled {
+		t.Fatal("expected spill files while merging")
+	}
+}
+
+func TestReducerMergesInPasses(t *testing.T) {
+	dir := t.TempDir()
+	in, want := feedDomainHits(200, 50, 1000)
+
+	// Far more spill files than the fan-in: they must be merged in several passes.
+	r := domainReducer(40, dir)
+	r.FanIn = 2
+	got, err := r.Collect(context.Background(), in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d keys, got %d", len(want), len(got))
+	}
+	for _, kv := range got {
+		if kv.Value != want[kv.Key] {
+			t.Fatalf("%s: got %+v, want %+v", kv.Key, kv.Value, want[kv.Key])
+		}
+	}
+	left, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Fatalf("spill files left behind: %v", left)
+	}
+}
+
+func TestReducerMemoryLimit(t *testing.T) {
+	dir := t.TempDir()
+	in, want := feedDomainHits(100, 50, 20)
+
+	// Few keys, but accumulators that keep growing: only the byte budget can make them spill.
+	r := &Reducer[domainHit, string, []int]{
+		Key:         func(h domainHit) string { return h.Domain },
+		Add:         func(acc []int, h domainHit) []int { return append(acc, h.Bytes) },
+		Merge:       func(a, b []int) []int { return append(a, b...) },
+		Workers:     2,
+		MemoryLimit: 16 * 1024,
+		Size:        func(key string, acc []int) int64 { return int64(len(key) + 8*cap(acc)) },
+		TempDir:     dir,
+	}
+	spilled := false
+	got := make(map[string]int)
+	err := r.Run(context.Background(), in, func(key string, values []int) error {
+		if !spilled {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				return err
+			}
+			spilled = len(entries) > 0
+		}
+		got[key] = len(values)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !spilled {
+		t.Fatal("expected spill files while merging")
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d keys, got %d", len(want), len(got))
+	}
+	for key, totals := range want {
+		if got[key] != totals.Hits {
+			t.Fatalf("%s: got %d values, want %d", key, got[key], totals.Hits)
+		}
+	}
+}
+
+func TestReducerStopsOnChunkError(t *testing.T) {
+	chunkErr := errors.New("bad chunk")
+	in := make(chan ProcessedChunk[domainHit], 2)
+	in <- ProcessedChunk[domainHit]{Items: []domainHit{{Domain: "a.example"}}}
+	in <- ProcessedChunk[domainHit]{Err: chunkErr}
+	close(in)
+
+	_, err := domainReducer(0, t.TempDir()).Collect(context.Background(), in)
+	if !errors.Is(err, chunkErr) {
+		t.Fatalf("expected %v, got %v", chunkErr, err)
+	}
+}
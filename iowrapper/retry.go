@@ -0,0 +1,182 @@
+package iowrapper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// RetryPolicy retries chunks whose processor returned an error. Delays start at Backoff and double
+// after every attempt up to MaxBackoff.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts per chunk. Values below 2 disable retries.
+	MaxAttempts int
+	// Backoff is the delay before the first retry. Defaults to 100ms.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between attempts. Defaults to 10s.
+	MaxBackoff time.Duration
+	// Retryable reports whether an error is transient. Nil treats every error as transient.
+	Retryable func(error) bool
+}
+
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	if d <= 0 {
+		d = 100 * time.Millisecond
+	}
+	limit := p.MaxBackoff
+	if limit <= 0 {
+		limit = 10 * time.Second
+	}
+	for i := 1; i < attempt && d < limit; i++ {
+		d *= 2
+	}
+	return min(d, limit)
+}
+
+// retryChunk runs fn on chunk until it succeeds, the error is not retryable, the attempts run out
+// or ctx is done. Panics are recovered into a *PanicError and never retried; *LineErrors are partial
+// results and are not retried either.
+func retryChunk[T any](ctx context.Context, policy RetryPolicy, chunk FileChunk, fn ChunkProcessorFunc[T]) ([]T, error) {
+	for attempt := 1; ; attempt++ {
+		items, err := safeProcess(chunk, fn)
+		if err == nil || attempt >= policy.MaxAttempts {
+			return items, err
+		}
+		var pe *PanicError
+		var le *LineErrors
+		if errors.As(err, &pe) || errors.As(err, &le) || (policy.Retryable != nil && !policy.Retryable(err)) {
+			return items, err
+		}
+
+		timer := time.NewTimer(policy.delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+// safeProcess calls fn and turns a panic into a *PanicError carrying the stack trace.
+func safeProcess[T any](chunk FileChunk, fn ChunkProcessorFunc[T]) (items []T, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			items = nil
+			err = &PanicError{
+				File:       chunk.File,
+				ChunkIndex: chunk.Chunk.Index,
+				Value:      r,
+				Stack:      debug.Stack(),
+			}
+		}
+	}()
+	return fn(chunk)
+}
+
+// DeadLetter is a chunk that could not be processed, with everything needed to replay it.
+type DeadLetter struct {
+	File       string `json:"file"`
+	ChunkIndex int    `json:"chunk_index"`
+	Offset     int64  `json:"offset"`
+	FirstLine  int64  `json:"first_line"`
+	Error      string `json:"error"`
+	Data       []byte `json:"data"`
+}
+
+// Chunk rebuilds the FileChunk the dead letter was created from.
+func (d DeadLetter) Chunk() FileChunk {
+	return FileChunk{
+		File:      d.File,
+		Chunk:     BytesChunk{Index: d.ChunkIndex, Data: d.Data},
+		Offset:    d.Offset,
+		FirstLine: d.FirstLine,
+	}
+}
+
+// DeadLetterWriter appends failed chunks to a compressed JSON Lines file. It is safe for concurrent use.
+type DeadLetterWriter struct {
+	mu     sync.Mutex
+	closer io.Closer
+	enc    *json.Encoder
+	count  int
+}
+
+// NewDeadLetterWriter creates the dead-letter file at path. The path must end in .gz, .zst or .zstd,
+// which selects the compression.
+func NewDeadLetterWriter(path string) (*DeadLetterWriter, error) {
+	if !isCompressed(path) {
+		return nil, fmt.Errorf("dead-letter path %s must end in .gz, .zst or .zstd", path)
+	}
+	w, closer, err := Writer(path, 64*1024)
+	if err != nil {
+		return nil, fmt.Errorf("create dead-letter file: %w", err)
+	}
+	return &DeadLetterWriter{closer: closer, enc: json.NewEncoder(w)}, nil
+}
+
+// Write appends a dead letter.
+func (d *DeadLetterWriter) Write(letter DeadLetter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.enc.Encode(letter); err != nil {
+		return err
+	}
+	d.count++
+	return nil
+}
+
+// Count returns the number of dead letters written so far.
+func (d *DeadLetterWriter) Count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.count
+}
+
+// Close flushes and closes the dead-letter file.
+func (d *DeadLetterWriter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.closer.Close()
+}
+
+func (d *DeadLetterWriter) add(chunk FileChunk, cause error) error {
+	return d.Write(DeadLetter{
+		File:       chunk.File,
+		ChunkIndex: chunk.Chunk.Index,
+		Offset:     chunk.Offset,
+		FirstLine:  chunk.FirstLine,
+		Error:      cause.Error(),
+		Data:       chunk.Chunk.Data,
+	})
+}
+
+// ReplayDeadLetters reads the dead-letter file at path and calls fn for every entry, in order.
+// Use DeadLetter.Chunk to feed the entries back into a ChunkProcessorFunc.
+func ReplayDeadLetters(path string, fn func(DeadLetter) error) error {
+	reader, closer, err := Reader(path, 64*1024)
+	if err != nil {
+		return fmt.Errorf("open dead-letter file: %w", err)
+	}
+	defer closer.Close()
+
+	dec := json.NewDecoder(reader)
+	for {
+		var letter DeadLetter
+		if err := dec.Decode(&letter); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("decode dead letter: %w", err)
+		}
+		if err := fn(letter); err != nil {
+			return err
+		}
+	}
+}
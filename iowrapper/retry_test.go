@@ -0,0 +1,307 @@
+package iowrapper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryChunk(t *testing.T) {
+	transient := errors.New("transient")
+	permanent := errors.New("permanent")
+	policy := RetryPolicy{
+		MaxAttempts: 4,
+		Backoff:     time.Millisecond,
+		Retryable:   func(err error) bool { return !errors.Is(err, permanent) },
+	}
+
+	var calls int
+	items, err := retryChunk(context.Background(), policy, FileChunk{}, func(FileChunk) ([]int, error) {
+		calls++
+		if calls < 3 {
+			return nil, transient
+		}
+		return []int{calls}, nil
+	})
+	if err != nil || len(items) != 1 || calls != 3 {
+		t.Fatalf("got items=%v err=%v after %d calls, want success on attempt 3", items, err, calls)
+	}
+
+	calls = 0
+	_, err = retryChunk(context.Background(), policy, FileChunk{}, func(FileChunk) ([]int, error) {
+		calls++
+		return nil, permanent
+	})
+	if !errors.Is(err, permanent) || calls != 1 {
+		t.Fatalf("permanent error: got %v after %d calls, want 1 call", err, calls)
+	}
+
+	calls = 0
+	_, err = retryChunk(context.Background(), policy, FileChunk{}, func(FileChunk) ([]int, error) {
+		calls++
+		return nil, transient
+	})
+	if !errors.Is(err, transient) || calls != policy.MaxAttempts {
+		t.Fatalf("exhausted retries: got %v after %d calls, want %d calls", err, calls, policy.MaxAttempts)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	want := []time.Duration{10, 20, 40, 50, 50}
+	for i, w := range want {
+		if got := p.delay(i + 1); got != w*time.Millisecond {
+			t.Fatalf("delay(%d) = %v, want %v", i+1, got, w*time.Millisecond)
+		}
+	}
+}
+
+func TestPipelineDeadLetters(t *testing.T) {
+	const linesPerFile = 2000
+
+	_, files, cleanup := createFakeLogFiles(t, 2, linesPerFile)
+	defer cleanup()
+
+	dlPath := filepath.Join(t.TempDir(), "dead.jsonl.zst")
+	dl, err := NewDeadLetterWriter(dlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bad := errors.New("chunk 1 is cursed")
+	var attempts atomic.Int32
+	var mu sync.Mutex
+	failed := make(map[string]FileChunk)
+	processor := func(chunk FileChunk) ([]FakeLogRecord, error) {
+		if chunk.File == files[0] && chunk.Chunk.Index == 1 {
+			attempts.Add(1)
+			mu.Lock()
+			failed[chunk.File] = chunk
+			mu.Unlock()
+			return nil, bad
+		}
+		return parseChunkToFakeLogRecords(chunk)
+	}
+
+	collected := make(map[string]int)
+	p := &Pipeline[FakeLogRecord]{
+		Sources:          files,
+		ProcessorWorkers: 4,
+		ChunkSize:        4 * 1024,
+		Retry:            RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond},
+		DeadLetter:       dl,
+		Processor:        processor,
+		Sink: func(file string, items []FakeLogRecord) error {
+			collected[file] += len(items)
+			return nil
+		},
+	}
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if err := dl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := attempts.Load(); got != 3 {
+		t.Fatalf("expected 3 attempts for the failing chunk, got %d", got)
+	}
+	if dl.Count() != 1 {
+		t.Fatalf("expected 1 dead letter, got %d", dl.Count())
+	}
+	if collected[files[1]] != linesPerFile {
+		t.Fatalf("expected %d records for %s, got %d", linesPerFile, files[1], collected[files[1]])
+	}
+
+	var letters []DeadLetter
+	if err := ReplayDeadLetters(dlPath, func(d DeadLetter) error {
+		letters = append(letters, d)
+		return nil
+	}); err != nil {
+		t.Fatalf("ReplayDeadLetters: %v", err)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("expected 1 dead letter on replay, got %d", len(letters))
+	}
+	d := letters[0]
+	want := failed[files[0]]
+	if d.File != files[0] || d.ChunkIndex != 1 || d.Error != bad.Error() || !bytes.Equal(d.Data, want.Chunk.Data) {
+		t.Fatalf("unexpected dead letter %+v", d)
+	}
+	if c := d.Chunk(); c.Offset != want.Offset || c.FirstLine != want.FirstLine || want.FirstLine <= 1 {
+		t.Fatalf("replayed chunk at offset %d line %d, want %d and %d", c.Offset, c.FirstLine, want.Offset, want.FirstLine)
+	}
+
+	// Replaying through LineProcessor keeps the line numbers of the original run.
+	lines, err := LineProcessor(func(_ []byte, pos LinePos) (int64, bool, error) {
+		return pos.Line, true, nil
+	})(d.Chunk())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) == 0 || lines[0] != want.FirstLine {
+		t.Fatalf("replayed lines start at %v, want %d", lines[:min(len(lines), 1)], want.FirstLine)
+	}
+
+	records, err := parseChunkToFakeLogRecords(d.Chunk())
+	if err != nil {
+		t.Fatalf("replaying dead letter: %v", err)
+	}
+	if collected[files[0]]+len(records) != linesPerFile {
+		t.Fatalf("replayed %d records, processed %d, want %d in total", len(records), collected[files[0]], linesPerFile)
+	}
+}
+
+func TestNewDeadLetterWriterRequiresCompression(t *testing.T) {
+	if _, err := NewDeadLetterWriter(filepath.Join(t.TempDir(), "dead.jsonl")); err == nil {
+		t.Fatal("expected error for uncompressed dead-letter path")
+	}
+}
+
+func TestSafeProcessRecoversPanic(t *testing.T) {
+	chunk := FileChunk{File: "a.log", Chunk: BytesChunk{Index: 7}}
+	_, err := safeProcess(chunk, func(FileChunk) ([]int, error) {
+		var m map[string]int
+		m["boom"]++
+		return nil, nil
+	})
+
+	var pe *PanicError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected *PanicError, got %v", err)
+	}
+	if pe.File != "a.log" || pe.ChunkIndex != 7 || len(pe.Stack) == 0 {
+		t.Fatalf("unexpected panic error %+v", pe)
+	}
+	if !strings.Contains(err.Error(), "assignment to entry in nil map") {
+		t.Fatalf("panic value missing from %q", err.Error())
+	}
+}
+
+func TestPipelinePanicFollowsFailurePolicy(t *testing.T) {
+	const linesPerFile = 2000
+
+	_, files, cleanup := createFakeLogFiles(t, 3, linesPerFile)
+	defer cleanup()
+
+	var chunk1Lines atomic.Int32
+	processor := func(chunk FileChunk) ([]FakeLogRecord, error) {
+		if chunk.File == files[0] && chunk.Chunk.Index == 1 {
+			chunk1Lines.Store(int32(bytes.Count(chunk.Chunk.Data, []byte{'\n'})))
+			panic("processor bug")
+		}
+		return parseChunkToFakeLogRecords(chunk)
+	}
+
+	run := func(policy FailurePolicy) (map[string]int, []string, error) {
+		collected := make(map[string]int)
+		var failed []string
+		p := &Pipeline[FakeLogRecord]{
+			Sources:          files,
+			ReaderWorkers:    2,
+			ProcessorWorkers: 4,
+			ChunkSize:        4 * 1024,
+			FailurePolicy:    policy,
+			InputOrder:       true,
+			Retry:            RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond},
+			Processor:        processor,
+			Sink: func(file string, items []FakeLogRecord) error {
+				collected[file] += len(items)
+				return nil
+			},
+			Hooks: FileHooks{OnFailed: func(file string, _ error) { failed = append(failed, file) }},
+		}
+		return collected, failed, p.Run(context.Background())
+	}
+
+	t.Run("fail-fast", func(t *testing.T) {
+		_, _, err := run(FailFast)
+		var pe *PanicError
+		if !errors.As(err, &pe) || pe.File != files[0] || pe.ChunkIndex != 1 {
+			t.Fatalf("expected *PanicError for %s chunk 1, got %v", files[0], err)
+		}
+	})
+
+	t.Run("skip-file", func(t *testing.T) {
+		collected, failed, err := run(SkipFile)
+		var report *FailureReport
+		if !errors.As(err, &report) || len(report.Files()) != 1 || report.Files()[0] != files[0] {
+			t.Fatalf("expected failure report for %s, got %v", files[0], err)
+		}
+		if len(failed) != 1 || failed[0] != files[0] {
+			t.Fatalf("OnFailed calls = %v, want [%s]", failed, files[0])
+		}
+		for _, path := range files[1:] {
+			if collected[path] != linesPerFile {
+				t.Fatalf("file %s: expected %d records, got %d", path, linesPerFile, collected[path])
+			}
+		}
+	})
+
+	t.Run("continue", func(t *testing.T) {
+		collected, failed, err := run(ContinueOnError)
+		var pe *PanicError
+		if !errors.As(err, &pe) {
+			t.Fatalf("expected report wrapping *PanicError, got %v", err)
+		}
+		if len(failed) != 0 {
+			t.Fatalf("expected no failed files, got %v", failed)
+		}
+		if want := linesPerFile - int(chunk1Lines.Load()); collected[files[0]] != want {
+			t.Fatalf("file %s: expected %d records, got %d", files[0], want, collected[files[0]])
+		}
+		for _, path := range files[1:] {
+			if collected[path] != linesPerFile {
+				t.Fatalf("file %s: expected %d records, got %d", path, linesPerFile, collected[path])
+			}
+		}
+	})
+}
+
+func TestCollectOrderedKeepsResultsOnContinue(t *testing.T) {
+	const linesPerFile = 500
+
+	_, files, cleanup := createFakeLogFiles(t, 3, linesPerFile)
+	defer cleanup()
+
+	procErr := errors.New("bad file")
+	processor := func(chunk FileChunk) ([]FakeLogRecord, error) {
+		if chunk.File == files[0] {
+			return nil, procErr
+		}
+		return parseChunkToFakeLogRecords(chunk)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fileCh := StartFileProducer(ctx, files)
+	chunkCh, errCh := StartChunkWorkers(ctx, 2, 4*1024, fileCh, WithFailurePolicy(ContinueOnError))
+	processed := StartChunkProcessors(ctx, 2, chunkCh, processor)
+	results, err := CollectOrdered(ctx, processed, WithFailurePolicy(ContinueOnError))
+	if readErr := CollectErrors(errCh); readErr != nil {
+		t.Fatal(readErr)
+	}
+
+	var report *FailureReport
+	if !errors.As(err, &report) || !errors.Is(err, procErr) {
+		t.Fatalf("expected failure report wrapping %v, got %v", procErr, err)
+	}
+	if got := report.Files(); len(got) != 1 || got[0] != files[0] {
+		t.Fatalf("failed files = %v, want [%s]", got, files[0])
+	}
+	if len(results[files[0]]) != 0 {
+		t.Fatalf("expected no records for %s, got %d", files[0], len(results[files[0]]))
+	}
+	for _, path := range files[1:] {
+		if len(results[path]) != linesPerFile {
+			t.Fatalf("file %s: expected %d records, got %d", path, linesPerFile, len(results[path]))
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package iowrapper
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"runtime"
+)
+
+// DefaultChunkSize is the chunk size used by Pipeline when ChunkSize is not set.
+const DefaultChunkSize = 4 * 1024 * 1024
+
+// Pipeline wires the Start* stages into a single run: files from Sources are read by ReaderWorkers,
+// split into chunks, transformed by ProcessorWorkers running Processor and delivered to Sink in
+// order per file. The zero value of every optional field selects a sensible default.
+type Pipeline[T any] struct {
+	// Sources lists the files to process. "-" reads from stdin.
+	Sources []string
+	// FS, when set, is where Sources are opened, instead of the operating system. Pair it with
+	// LargestFirstFS rather than LargestFirst when scheduling by size.
+	FS fs.FS
+	// ReaderWorkers is the number of files read concurrently. Defaults to 1.
+	ReaderWorkers int
+	// ProcessorWorkers is the number of chunks processed concurrently. Defaults to runtime.NumCPU().
+	ProcessorWorkers int
+	// ChunkSize is the approximate size of a chunk in bytes. Defaults to DefaultChunkSize.
+	ChunkSize int
+	// Splitter splits files into chunks. Defaults to SliceToBytesChunks2.
+	Splitter SplitterFunc
+	// Processor converts a chunk into items. Required.
+	Processor ChunkProcessorFunc[T]
+	// Sink receives the items of each chunk, in chunk order per file. Required.
+	Sink func(file string, items []T) error
+	// FailurePolicy decides whether a file that fails to read or process stops the run.
+	// Defaults to FailFast.
+	FailurePolicy FailurePolicy
+	// ReorderLimits bounds the chunks held between the readers and the sink. Readers block while the
+	// limits are exceeded. Defaults to unlimited.
+	ReorderLimits ReorderLimits
+	// Hooks receives per-file lifecycle events in order with the Sink calls.
+	Hooks FileHooks
+	// InputOrder emits whole files in the order they are read (the order of Sources, or of Schedule
+	// when set) instead of interleaving them as they complete, making the output deterministic.
+	InputOrder bool
+	// Schedule decides the order in which Sources are read. Defaults to the order of Sources.
+	Schedule Schedule
+	// Checkpoint, when set, records progress so that a restarted run skips completed files and
+	// resumes in-flight ones. It is saved periodically and once more when Run returns.
+	Checkpoint *Checkpoint
+	// Retry retries chunks whose Processor fails.
+	Retry RetryPolicy
+	// DeadLetter receives chunks that still fail after retries, instead of failing the run.
+	// The caller closes it after Run returns.
+	DeadLetter *DeadLetterWriter
+	// Metrics, when set, is updated by every stage while the run is in progress.
+	Metrics *Metrics
+	// Progress, when set, is started with the sources of the run and stopped when Run returns.
+	Progress *Progress
+	// Autoscale, when set, adapts the chunk size and worker counts during the run, starting from
+	// ChunkSize, ReaderWorkers and ProcessorWorkers.
+	Autoscale *Autoscaler
+	// Sample restricts the run to a sample of the input, for a trial run of Processor. It cannot be
+	// combined with Checkpoint.
+	Sample Sampling
+	// DryRun reads and processes the input, or its Sample, but drops the items instead of passing them
+	// to Sink, which may then be nil. Hooks and Metrics still report what the run would have produced.
+	// It cannot be combined with Checkpoint.
+	DryRun bool
+}
+
+// Run executes the pipeline and blocks until every stage has stopped. The returned error joins
+// the sink or processor error that stopped the run with a *FailureReport listing the files that
+// failed to read or process; it is nil on success.
+func (p *Pipeline[T]) Run(ctx context.Context) error {
+	if p.Processor == nil {
+		return errors.New("iowrapper: pipeline has no processor")
+	}
+	if p.Sink == nil && !p.DryRun {
+		return errors.New("iowrapper: pipeline has no sink")
+	}
+
+	sources := p.Sources
+	if p.Checkpoint != nil {
+		sources = p.Checkpoint.PendingFS(p.FS, sources)
+	}
+	// Schedule up front so that the input order matches the order the files are read in: holding back
+	// a file that has not been picked up yet could stall readers waiting on the reorder budget.
+	if p.Schedule != nil {
+		sources = p.Schedule(sources)
+	}
+	if p.Progress != nil {
+		p.Progress.start(p.FS, sources)
+		defer p.Progress.Stop()
+	}
+
+	opts := p.stageOptions()
+	if p.InputOrder {
+		opts = append(opts, WithInputOrder(sources))
+	}
+	produce := func(ctx context.Context) <-chan FileJob {
+		return StartFileProducer(ctx, sources)
+	}
+	return p.run(ctx, produce, p.Sink, opts)
+}
+
+// stageOptions translates the pipeline settings into stage options. The input order is left to the caller.
+func (p *Pipeline[T]) stageOptions() []StageOption {
+	opts := []StageOption{
+		WithFS(p.FS),
+		WithSplitter(p.Splitter),
+		WithFailurePolicy(p.FailurePolicy),
+		WithFileHooks(p.Hooks),
+		WithRetry(p.Retry),
+		WithSample(p.Sample),
+	}
+	if p.DeadLetter != nil {
+		opts = append(opts, WithDeadLetter(p.DeadLetter))
+	}
+	if p.Metrics != nil {
+		opts = append(opts, WithMetrics(p.Metrics))
+	}
+	if p.Autoscale != nil {
+		opts = append(opts, WithAutoscale(p.Autoscale))
+	}
+	if p.Progress != nil {
+		opts = append(opts, WithProgress(p.Progress))
+	}
+	if p.Checkpoint != nil {
+		opts = append(opts, WithCheckpoint(p.Checkpoint))
+	}
+	if !p.ReorderLimits.isZero() {
+		opts = append(opts, WithReorderBudget(NewReorderBudget(p.ReorderLimits)))
+	}
+	return opts
+}
+
+// run wires the files sent by produce through the readers, the processors and the ordered collector
+// into sink, and returns once every stage has exited, even when sink panics.
+func (p *Pipeline[T]) run(ctx context.Context, produce func(context.Context) <-chan FileJob, sink func(string, []T) error, opts []StageOption) error {
+	if p.Checkpoint != nil && (!p.Sample.isZero() || p.DryRun) {
+		return errSampledCheckpoint
+	}
+	if p.DryRun {
+		sink = discard[T]
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	files := produce(runCtx)
+	chunks, errCh := StartChunkWorkers(runCtx, p.readerWorkers(), p.chunkSize(), files, opts...)
+	processed := StartChunkProcessors(runCtx, p.processorWorkers(), chunks, p.Processor, opts...)
+
+	var report FailureReport
+	readersDone := make(chan struct{})
+	go func() {
+		defer close(readersDone)
+		for err := range errCh {
+			report.add(err)
+			if p.FailurePolicy == FailFast {
+				cancel()
+			}
+		}
+	}()
+
+	// Stop the remaining stages and wait for all of them to exit.
+	stop := func() {
+		cancel()
+		for range processed {
+		}
+		for range files {
+		}
+		<-readersDone
+	}
+	defer stop()
+
+	sinkErr := StreamOrdered(runCtx, processed, sink, opts...)
+	stop()
+
+	// Processing failures reported by the collector join the readers' report.
+	var collected *FailureReport
+	if errors.As(sinkErr, &collected) {
+		report.Errors = append(report.Errors, collected.Errors...)
+		sinkErr = nil
+	}
+
+	var errs []error
+	if sinkErr != nil && !isContextErr(sinkErr) {
+		errs = append(errs, sinkErr)
+	}
+	if len(report.Errors) > 0 {
+		errs = append(errs, &report)
+	}
+	if p.Checkpoint != nil {
+		if err := p.Checkpoint.Save(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// discard is a sink that drops the items, used by dry runs.
+func discard[T any](string, []T) error { return nil }
+
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func (p *Pipeline[T]) readerWorkers() int {
+	if p.ReaderWorkers <= 0 {
+		return 1
+	}
+	return p.ReaderWorkers
+}
+
+func (p *Pipeline[T]) processorWorkers() int {
+	if p.ProcessorWorkers <= 0 {
+		return runtime.NumCPU()
+	}
+	return p.ProcessorWorkers
+}
+
+func (p *Pipeline[T]) chunkSize() int {
+	if p.ChunkSize <= 0 {
+		return DefaultChunkSize
+	}
+	return p.ChunkSize
+}
@@ -0,0 +1,151 @@
+package iowrapper
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestPipelineRun(t *testing.T) {
+	const linesPerFile = 5000
+
+	_, files, cleanup := createFakeLogFiles(t, 4, linesPerFile)
+	defer cleanup()
+
+	collected := make(map[string][]FakeLogRecord)
+	p := &Pipeline[FakeLogRecord]{
+		Sources:          files,
+		ReaderWorkers:    2,
+		ProcessorWorkers: 4,
+		ChunkSize:        16 * 1024,
+		Processor:        parseChunkToFakeLogRecords,
+		Sink: func(file string, items []FakeLogRecord) error {
+			collected[file] = append(collected[file], items...)
+			return nil
+		},
+	}
+
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	for _, path := range files {
+		records := collected[path]
+		if len(records) != linesPerFile {
+			t.Fatalf("file %s expected %d records, got %d", path, linesPerFile, len(records))
+		}
+		for idx, rec := range records {
+			if rec.Index != idx {
+				t.Fatalf("record index mismatch for %s: got %d want %d", path, rec.Index, idx)
+			}
+		}
+	}
+}
+
+func TestPipelineRunAggregatesErrors(t *testing.T) {
+	dir, files, cleanup := createFakeLogFiles(t, 2, 100)
+	defer cleanup()
+
+	missing := filepath.Join(dir, "missing.log")
+	sinkErr := errors.New("sink failed")
+
+	p := &Pipeline[FakeLogRecord]{
+		Sources:       append([]string{missing}, files...),
+		ReaderWorkers: 2,
+		ChunkSize:     1024,
+		FailurePolicy: ContinueOnError,
+		Processor:     parseChunkToFakeLogRecords,
+		Sink: func(string, []FakeLogRecord) error {
+			return sinkErr
+		},
+	}
+
+	err := p.Run(context.Background())
+	if !errors.Is(err, sinkErr) {
+		t.Fatalf("expected sink error, got %v", err)
+	}
+	var report *FailureReport
+	if !errors.As(err, &report) || len(report.Files()) != 1 || report.Files()[0] != missing {
+		t.Fatalf("expected failure report for %s, got %v", missing, err)
+	}
+}
+
+func TestPipelineRunFailFast(t *testing.T) {
+	dir, files, cleanup := createFakeLogFiles(t, 2, 100)
+	defer cleanup()
+
+	missing := filepath.Join(dir, "missing.log")
+	p := &Pipeline[FakeLogRecord]{
+		Sources:   append([]string{missing}, files...),
+		ChunkSize: 1024,
+		Processor: parseChunkToFakeLogRecords,
+		Sink:      func(string, []FakeLogRecord) error { return nil },
+	}
+
+	err := p.Run(context.Background())
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected reader error for missing file, got %v", err)
+	}
+}
+
+func TestPipelineRunRequiresProcessorAndSink(t *testing.T) {
+	p := &Pipeline[string]{}
+	if err := p.Run(context.Background()); err == nil {
+		t.Fatal("expected error for pipeline without processor")
+	}
+	p.Processor = func(FileChunk) ([]string, error) { return nil, nil }
+	if err := p.Run(context.Background()); err == nil {
+		t.Fatal("expected error for pipeline without sink")
+	}
+}
+
+func TestPipelineRunCancelled(t *testing.T) {
+	_, files, cleanup := createFakeLogFiles(t, 2, 1000)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p := &Pipeline[FakeLogRecord]{
+		Sources:   files,
+		Processor: parseChunkToFakeLogRecords,
+		Sink:      func(string, []FakeLogRecord) error { return nil },
+	}
+	if err := p.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestPipelineRunCancelMidStreamLeavesNoGoroutines(t *testing.T) {
+	_, files, cleanup := createFakeLogFiles(t, 4, 20000)
+	defer cleanup()
+
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := 0
+	p := &Pipeline[FakeLogRecord]{
+		Sources:          files,
+		ReaderWorkers:    2,
+		ProcessorWorkers: 4,
+		ChunkSize:        4 * 1024,
+		Processor:        parseChunkToFakeLogRecords,
+		Sink: func(string, []FakeLogRecord) error {
+			calls++
+			if calls == 5 {
+				cancel()
+			}
+			return nil
+		},
+	}
+	if err := p.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	waitForGoroutines(t, before)
+}
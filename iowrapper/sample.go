@@ -0,0 +1,299 @@
+package iowrapper
+
+import (
+	"bytes"
+	"cmp"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Sampling restricts a run to part of its input, to try processors on a representative sample before
+// running the full job. Sampled chunks go through the processors like any other chunk. Pass it to
+// StartChunkWorkers with WithSample, or set Pipeline.Sample; the zero value samples nothing.
+//
+// The settings combine in the order they are listed: EveryNthChunk picks chunks, HeadLines limits the
+// lines taken from them and Reservoir samples from those lines. Sampling does not work together with
+// a Checkpoint.
+type Sampling struct {
+	// EveryNthChunk keeps the chunks 0, N, 2N, ... of every file.
+	EveryNthChunk int
+	// HeadLines keeps the first HeadLines lines of every file and stops reading it there.
+	HeadLines int
+	// Reservoir keeps a uniform random sample of Reservoir lines of every file, or of all files
+	// together with ReservoirOverall. The lines of a file are passed on in file order, as a single
+	// chunk sent once the file has been read; with ReservoirOverall, once every file has been read.
+	Reservoir        int
+	ReservoirOverall bool
+	// Seed selects the random sample. The same seed over the same input selects the same lines,
+	// whatever the chunk size and the number of workers.
+	Seed uint64
+}
+
+// errSampledCheckpoint rejects a checkpoint on a sampled or dry run, which would record files as
+// completed that were only partly processed.
+var errSampledCheckpoint = errors.New("iowrapper: a sampled or dry run cannot use a checkpoint")
+
+func (s Sampling) isZero() bool {
+	return s.EveryNthChunk <= 1 && s.HeadLines <= 0 && s.Reservoir <= 0
+}
+
+// WithSample makes StartChunkWorkers pass on only the sample of the input selected by s. Combined
+// with WithCheckpoint, StartChunkWorkers reads nothing and reports an error.
+func WithSample(s Sampling) StageOption {
+	return func(o *stageOptions) {
+		if !s.isZero() {
+			o.sample = &s
+		}
+	}
+}
+
+// streamSampled is the loop of stream for sampled runs. Kept chunks are sent as they come and the
+// summary follows in a data-less chunk, as the last kept chunk is not known in advance; with
+// ReservoirOverall the summary is left to finishSample. stop stops the reads from src.
+func (s *fileStream) streamSampled(src *contextReader, ch <-chan BytesChunk, stop context.CancelFunc) error {
+	sample := s.sample
+	var res *reservoir
+	if sample.Reservoir > 0 {
+		res = newReservoir(sample.Reservoir, sample.Seed)
+	}
+
+	read, kept := 0, 0
+	stopped := false
+	waited := time.Now()
+	for chunk := range ch {
+		if stopped {
+			// At most one chunk the splitter had in flight when reading stopped.
+			continue
+		}
+		lines := countLines(chunk.Data)
+		s.metrics.chunkRead(len(chunk.Data), lines, time.Since(waited))
+		s.summary.Chunks++
+		s.summary.Bytes += int64(len(chunk.Data))
+		s.summary.Lines += lines
+
+		n := read
+		read++
+		if sample.EveryNthChunk > 1 && n%sample.EveryNthChunk != 0 {
+			s.skip(chunk.Data)
+			waited = time.Now()
+			continue
+		}
+		data := chunk.Data
+		if sample.HeadLines > 0 {
+			data = headLines(data, sample.HeadLines-kept)
+			kept += int(countLines(data))
+			if kept >= sample.HeadLines {
+				stopped = true
+				stop()
+			}
+		}
+		if res != nil {
+			res.addLines(s.path, s.offset, s.lines, data)
+			s.skip(chunk.Data)
+			waited = time.Now()
+			continue
+		}
+		if len(data) > 0 {
+			if err := s.send(BytesChunk{Data: data}, nil); err != nil {
+				return err
+			}
+		}
+		s.skip(chunk.Data[len(data):])
+		waited = time.Now()
+	}
+	if src.err != nil && !stopped {
+		return fmt.Errorf("read: %w", src.err)
+	}
+
+	if s.overall != nil {
+		s.overall.merge(s.path, res, s.summary)
+		return nil
+	}
+	if res != nil {
+		if err := s.sendSampled(res.lines); err != nil {
+			return err
+		}
+	}
+	summary := s.summary
+	return s.send(BytesChunk{}, &summary)
+}
+
+// skip accounts for data that was read but not sent.
+func (s *fileStream) skip(data []byte) {
+	s.offset += int64(len(data))
+	s.lines += countLines(data)
+}
+
+// sendSampled sends lines in file order, one chunk per run of adjacent lines, each positioned at
+// its first line so that line numbers and offsets stay true.
+func (s *fileStream) sendSampled(lines []sampledLine) error {
+	slices.SortFunc(lines, func(a, b sampledLine) int { return cmp.Compare(a.line, b.line) })
+	for len(lines) > 0 {
+		n := 1
+		for n < len(lines) && lines[n].line == lines[n-1].line+1 {
+			n++
+		}
+		var data []byte
+		for _, l := range lines[:n] {
+			data = append(data, l.data...)
+			if data[len(data)-1] != '\n' {
+				data = append(data, '\n')
+			}
+		}
+		s.offset, s.lines = lines[0].offset, lines[0].line-1
+		if err := s.send(BytesChunk{Data: data}, nil); err != nil {
+			return err
+		}
+		lines = lines[n:]
+	}
+	return nil
+}
+
+// headLines returns the first n lines of data.
+func headLines(data []byte, n int) []byte {
+	if n <= 0 {
+		return nil
+	}
+	end := 0
+	for ; n > 0 && end < len(data); n-- {
+		i := bytes.IndexByte(data[end:], '\n')
+		if i < 0 {
+			return data
+		}
+		end += i + 1
+	}
+	return data[:end]
+}
+
+// sampledLine is a line kept by a reservoir, with its 1-based line number and offset in the file.
+type sampledLine struct {
+	hash   uint64
+	file   string
+	line   int64
+	offset int64
+	data   []byte
+}
+
+// reservoir keeps the k lines with the lowest hash of (seed, file, line number). As the hash is
+// uniform, that is a uniform random sample, and one that does not depend on the order in which the
+// lines arrive; the bottom k of a union is also the bottom k of the bottom k of its parts.
+type reservoir struct {
+	k     int
+	seed  uint64
+	lines []sampledLine
+}
+
+func newReservoir(k int, seed uint64) *reservoir {
+	return &reservoir{k: k, seed: seed}
+}
+
+// addLines offers the lines of data, which starts at offset after the line numbered line.
+func (r *reservoir) addLines(file string, offset, line int64, data []byte) {
+	for len(data) > 0 {
+		end := len(data)
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			end = i + 1
+		}
+		line++
+		r.add(sampledLine{hash: sampleHash(r.seed, file, line), file: file, line: line, offset: offset, data: data[:end]})
+		offset += int64(end)
+		data = data[end:]
+	}
+}
+
+func (r *reservoir) add(l sampledLine) {
+	if len(r.lines) < r.k {
+		// Copy the line: the chunk it came from is not retained.
+		l.data = bytes.Clone(l.data)
+		heap.Push(r, l)
+		return
+	}
+	if l.hash < r.lines[0].hash {
+		l.data = bytes.Clone(l.data)
+		r.lines[0] = l
+		heap.Fix(r, 0)
+	}
+}
+
+// reservoir is a max-heap on hash, so that the line to evict is at the top.
+func (r *reservoir) Len() int           { return len(r.lines) }
+func (r *reservoir) Less(i, j int) bool { return r.lines[i].hash > r.lines[j].hash }
+func (r *reservoir) Swap(i, j int)      { r.lines[i], r.lines[j] = r.lines[j], r.lines[i] }
+func (r *reservoir) Push(x any)         { r.lines = append(r.lines, x.(sampledLine)) }
+func (r *reservoir) Pop() any {
+	l := r.lines[len(r.lines)-1]
+	r.lines = r.lines[:len(r.lines)-1]
+	return l
+}
+
+func sampleHash(seed uint64, file string, line int64) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], seed)
+	h.Write(buf[:])
+	h.Write([]byte(file))
+	binary.LittleEndian.PutUint64(buf[:], uint64(line))
+	h.Write(buf[:])
+	// FNV spreads nearby line numbers poorly; finish with the splitmix64 mixer.
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// overallReservoir collects the per-file reservoirs of a ReservoirOverall run together with the
+// summaries of the files, which are held back until every file has been read.
+type overallReservoir struct {
+	mu        sync.Mutex
+	res       *reservoir
+	files     []string
+	summaries map[string]FileSummary
+}
+
+func newOverallReservoir(s Sampling) *overallReservoir {
+	return &overallReservoir{res: newReservoir(s.Reservoir, s.Seed), summaries: make(map[string]FileSummary)}
+}
+
+// merge adds a file that was read successfully.
+func (o *overallReservoir) merge(file string, res *reservoir, summary FileSummary) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, l := range res.lines {
+		o.res.add(l)
+	}
+	o.files = append(o.files, file)
+	o.summaries[file] = summary
+}
+
+// finishSample sends the sampled lines and the summary of every file of a ReservoirOverall run, in
+// the order the files were read. It is called once all readers have exited.
+func finishSample(ctx context.Context, o *stageOptions, overall *overallReservoir, out chan<- FileChunk) {
+	byFile := make(map[string][]sampledLine)
+	for _, l := range overall.res.lines {
+		byFile[l.file] = append(byFile[l.file], l)
+	}
+	for _, file := range overall.files {
+		s := &fileStream{
+			ctx:       ctx,
+			path:      file,
+			budget:    o.budget,
+			metrics:   o.metrics,
+			autoscale: o.autoscale,
+			out:       out,
+		}
+		summary := overall.summaries[file]
+		if s.sendSampled(byFile[file]) != nil || s.send(BytesChunk{}, &summary) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package iowrapper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// runSampled runs parseChunkToFakeLogRecords over files with sample and returns the record indexes per file.
+func runSampled(t *testing.T, files []string, sample Sampling, chunkSize, workers int) (map[string][]int, map[string]FileStats) {
+	t.Helper()
+	indexes := make(map[string][]int)
+	stats := make(map[string]FileStats)
+	p := &Pipeline[FakeLogRecord]{
+		Sources:          files,
+		ReaderWorkers:    workers,
+		ProcessorWorkers: workers,
+		ChunkSize:        chunkSize,
+		Sample:           sample,
+		Processor:        parseChunkToFakeLogRecords,
+		Sink: func(file string, items []FakeLogRecord) error {
+			for _, rec := range items {
+				indexes[file] = append(indexes[file], rec.Index)
+			}
+			return nil
+		},
+		Hooks: FileHooks{OnComplete: func(s FileStats) { stats[s.File] = s }},
+	}
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	return indexes, stats
+}
+
+func TestSampleHeadLines(t *testing.T) {
+	const linesPerFile = 5000
+	_, files, cleanup := createFakeLogFiles(t, 3, linesPerFile)
+	defer cleanup()
+
+	indexes, stats := runSampled(t, files, Sampling{HeadLines: 25}, 1024, 2)
+	for _, file := range files {
+		want := make([]int, 25)
+		for i := range want {
+			want[i] = i
+		}
+		if !reflect.DeepEqual(indexes[file], want) {
+			t.Fatalf("%s: got %v", file, indexes[file])
+		}
+		if stats[file].Lines >= linesPerFile {
+			t.Fatalf("%s: read all %d lines instead of stopping early", file, stats[file].Lines)
+		}
+	}
+}
+
+func TestSampleEveryNthChunk(t *testing.T) {
+	_, files, cleanup := createFakeLogFiles(t, 1, 2000)
+	defer cleanup()
+	content, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	chunks, errCh := StartChunkWorkers(ctx, 1, 1024, StartFileProducer(ctx, files), WithSample(Sampling{EveryNthChunk: 3}))
+	var all []FileChunk
+	for chunk := range chunks {
+		all = append(all, chunk)
+	}
+	if err := CollectErrors(errCh); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compare with the unsampled chunks of the same file.
+	plain, errCh := StartChunkWorkers(ctx, 1, 1024, StartFileProducer(ctx, files))
+	var want []string
+	n := 0
+	for chunk := range plain {
+		if n%3 == 0 {
+			want = append(want, string(chunk.Chunk.Data))
+		}
+		n++
+	}
+	if err := CollectErrors(errCh); err != nil {
+		t.Fatal(err)
+	}
+
+	last := all[len(all)-1]
+	if last.Summary == nil || len(last.Chunk.Data) != 0 || last.Summary.Lines != 2000 {
+		t.Fatalf("expected a data-less summary chunk for the whole file, got %+v", last)
+	}
+	var got []string
+	for i, chunk := range all[:len(all)-1] {
+		if chunk.Chunk.Index != i {
+			t.Fatalf("chunk %d has index %d", i, chunk.Chunk.Index)
+		}
+		if string(content[chunk.Offset:chunk.Offset+int64(len(chunk.Chunk.Data))]) != string(chunk.Chunk.Data) {
+			t.Fatalf("chunk %d: offset %d does not match its data", i, chunk.Offset)
+		}
+		if want := int64(strings.Count(string(content[:chunk.Offset]), "\n")) + 1; chunk.FirstLine != want {
+			t.Fatalf("chunk %d: first line %d, want %d", i, chunk.FirstLine, want)
+		}
+		got = append(got, string(chunk.Chunk.Data))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %d chunks, want %d", len(got), len(want))
+	}
+}
+
+func TestSampleReservoirIsReproducible(t *testing.T) {
+	_, files, cleanup := createFakeLogFiles(t, 3, 3000)
+	defer cleanup()
+
+	sample := Sampling{Reservoir: 40, Seed: 7}
+	first, _ := runSampled(t, files, sample, 1024, 1)
+	second, _ := runSampled(t, files, sample, 16*1024, 4)
+	if !reflect.DeepEqual(first, second) {
+		t.Fatal("same seed selected different lines")
+	}
+	for _, file := range files {
+		got := first[file]
+		if len(got) != 40 {
+			t.Fatalf("%s: got %d lines, want 40", file, len(got))
+		}
+		for i := 1; i < len(got); i++ {
+			if got[i] <= got[i-1] {
+				t.Fatalf("%s: lines not in file order: %v", file, got)
+			}
+		}
+		// A sample of a whole file should not cluster at its start.
+		if got[len(got)-1] < 1500 {
+			t.Fatalf("%s: sample does not cover the file: %v", file, got)
+		}
+	}
+
+	other, _ := runSampled(t, files, Sampling{Reservoir: 40, Seed: 8}, 1024, 1)
+	if reflect.DeepEqual(first, other) {
+		t.Fatal("different seeds selected the same lines")
+	}
+}
+
+func TestSampleReservoirOverall(t *testing.T) {
+	_, files, cleanup := createFakeLogFiles(t, 4, 1000)
+	defer cleanup()
+
+	sample := Sampling{Reservoir: 30, ReservoirOverall: true, Seed: 1}
+	first, stats := runSampled(t, files, sample, 1024, 2)
+	second, _ := runSampled(t, files, sample, 4096, 3)
+	if !reflect.DeepEqual(first, second) {
+		t.Fatal("same seed selected different lines")
+	}
+	total := 0
+	for _, file := range files {
+		total += len(first[file])
+		if stats[file].Lines != 1000 {
+			t.Fatalf("%s: summary counts %d lines", file, stats[file].Lines)
+		}
+	}
+	if total != 30 {
+		t.Fatalf("got %d lines overall, want 30", total)
+	}
+}
+
+func TestSampleReservoirLinePositions(t *testing.T) {
+	_, files, cleanup := createFakeLogFiles(t, 2, 2000)
+	defer cleanup()
+	contents := make(map[string][]byte)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[file] = data
+	}
+
+	for _, overall := range []bool{false, true} {
+		var checked int
+		p := &Pipeline[LinePos]{
+			Sources:   files,
+			ChunkSize: 4096,
+			Sample:    Sampling{Reservoir: 20, ReservoirOverall: overall, Seed: 3},
+			Processor: LineProcessor(func(line []byte, pos LinePos) (LinePos, bool, error) {
+				recs, err := parseChunkToFakeLogRecords(FileChunk{File: pos.File, Chunk: BytesChunk{Data: line}})
+				if err != nil {
+					return pos, false, err
+				}
+				if int64(recs[0].Index)+1 != pos.Line {
+					return pos, false, fmt.Errorf("line %d reported at %v", recs[0].Index+1, pos)
+				}
+				if !bytes.HasPrefix(contents[pos.File][pos.Offset:], line) {
+					return pos, false, fmt.Errorf("offset of %v does not match its line", pos)
+				}
+				return pos, true, nil
+			}),
+			Sink: func(_ string, items []LinePos) error {
+				checked += len(items)
+				return nil
+			},
+			Hooks: FileHooks{OnLineErrors: func(_ string, errs []LineError) {
+				t.Errorf("overall=%v: %v", overall, errs[0].Err)
+			}},
+		}
+		if err := p.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		want := 20 * len(files)
+		if overall {
+			want = 20
+		}
+		if checked != want {
+			t.Fatalf("overall=%v: checked %d lines, want %d", overall, checked, want)
+		}
+	}
+}
+
+func TestSampleRejectsCheckpoint(t *testing.T) {
+	cp, err := LoadCheckpoint(t.TempDir() + "/checkpoint.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*Pipeline[FakeLogRecord]{
+		{Sample: Sampling{HeadLines: 1}},
+		{DryRun: true},
+	} {
+		p.Sources = []string{"unused.log"}
+		p.Checkpoint = cp
+		p.Processor = parseChunkToFakeLogRecords
+		p.Sink = func(string, []FakeLogRecord) error { return nil }
+		if err := p.Run(context.Background()); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+
+	ctx := context.Background()
+	chunks, errCh := StartChunkWorkers(ctx, 1, 1024, StartFileProducer(ctx, []string{"unused.log"}),
+		WithSample(Sampling{HeadLines: 1}), WithCheckpoint(cp))
+	for range chunks {
+		t.Fatal("expected no chunks")
+	}
+	if err := CollectErrors(errCh); !errors.Is(err, errSampledCheckpoint) {
+		t.Fatalf("expected %v, got %v", errSampledCheckpoint, err)
+	}
+
+	m := &Mirror[string]{
+		Pipeline:   Pipeline[string]{Processor: lineItems, Sample: Sampling{HeadLines: 1}},
+		InputRoot:  t.TempDir(),
+		OutputRoot: t.TempDir(),
+	}
+	if err := m.Run(ctx); err == nil {
+		t.Fatal("expected mirror to reject a sampled run")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	const linesPerFile = 1000
+	_, files, cleanup := createFakeLogFiles(t, 2, linesPerFile)
+	defer cleanup()
+
+	var items int
+	p := &Pipeline[FakeLogRecord]{
+		Sources:   files,
+		ChunkSize: 4096,
+		DryRun:    true,
+		Processor: parseChunkToFakeLogRecords,
+		Hooks:     FileHooks{OnComplete: func(s FileStats) { items += s.Items }},
+	}
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if items != 2*linesPerFile {
+		t.Fatalf("hooks counted %d items, want %d", items, 2*linesPerFile)
+	}
+}
+
+func TestHeadLines(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		n    int
+		want string
+	}{
+		{"a\nb\nc\n", 2, "a\nb\n"},
+		{"a\nb\nc\n", 5, "a\nb\nc\n"},
+		{"a\nb", 2, "a\nb"},
+		{"a\nb\n", 0, ""},
+	} {
+		if got := string(headLines([]byte(tc.data), tc.n)); got != tc.want {
+			t.Errorf("headLines(%q, %d) = %q, want %q", tc.data, tc.n, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package iowrapper
+
+import (
+	"cmp"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Schedule decides the order in which the file producer hands files to the chunk workers. It returns
+// a reordered copy and leaves files untouched. Pass one to StartFileProducer with WithSchedule, or set
+// Pipeline.Schedule.
+type Schedule func(files []string) []string
+
+// LargestFirst schedules files by decreasing size on disk, which for compressed files is the
+// compressed size. Starting the biggest files first keeps one worker from being left with a large
+// file after the others have gone idle. Stdin and files that cannot be stat'ed go last; files of
+// equal size keep their order.
+func LargestFirst(files []string) []string {
+	return LargestFirstFS(nil)(files)
+}
+
+// LargestFirstFS is LargestFirst for files in fsys.
+func LargestFirstFS(fsys fs.FS) Schedule {
+	return func(files []string) []string {
+		sizes := make(map[string]int64, len(files))
+		for _, file := range files {
+			sizes[file] = -1
+			if size, ok := fileSize(fsys, file); ok {
+				sizes[file] = size
+			}
+		}
+		out := slices.Clone(files)
+		slices.SortStableFunc(out, func(a, b string) int {
+			return cmp.Compare(sizes[b], sizes[a])
+		})
+		return out
+	}
+}
+
+// fileSize returns the size of file on disk, looked up in fsys when it is not nil. Stdin has no size.
+func fileSize(fsys fs.FS, file string) (int64, bool) {
+	if file == "-" {
+		return 0, false
+	}
+	var info fs.FileInfo
+	var err error
+	if fsys == nil {
+		info, err = os.Stat(file)
+	} else {
+		info, err = fs.Stat(fsys, file)
+	}
+	if err != nil {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+// RoundRobinDirs interleaves files from different directories, taking one file from each directory in
+// turn, so that concurrent readers spread over directories (and the disks behind them) instead of
+// working through one directory at a time. Directories are visited in order of first appearance and
+// files keep their order within a directory.
+func RoundRobinDirs(files []string) []string {
+	var dirs []string
+	byDir := make(map[string][]string)
+	for _, file := range files {
+		dir := filepath.Dir(file)
+		if _, ok := byDir[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		byDir[dir] = append(byDir[dir], file)
+	}
+
+	out := make([]string, 0, len(files))
+	for len(out) < len(files) {
+		for _, dir := range dirs {
+			if queue := byDir[dir]; len(queue) > 0 {
+				out = append(out, queue[0])
+				byDir[dir] = queue[1:]
+			}
+		}
+	}
+	return out
+}
+
+// ByPriority schedules files by decreasing priority(file). Files of equal priority keep their order.
+func ByPriority(priority func(file string) int) Schedule {
+	return func(files []string) []string {
+		prio := make(map[string]int, len(files))
+		for _, file := range files {
+			prio[file] = priority(file)
+		}
+		out := slices.Clone(files)
+		slices.SortStableFunc(out, func(a, b string) int {
+			return cmp.Compare(prio[b], prio[a])
+		})
+		return out
+	}
+}
@@ -0,0 +1,115 @@
+package iowrapper
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLargestFirst(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, size int) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(strings.Repeat("x", size)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	small := write("small.log", 10)
+	big := write("big.log.gz", 1000)
+	medium := write("medium.log", 100)
+	sameA := write("same-a.log", 50)
+	sameB := write("same-b.log", 50)
+	missing := filepath.Join(dir, "missing.log")
+
+	files := []string{"-", small, missing, sameA, big, sameB, medium}
+	got := LargestFirst(files)
+	want := []string{big, medium, sameA, sameB, small, "-", missing}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("LargestFirst = %v, want %v", got, want)
+	}
+	if files[0] != "-" {
+		t.Fatal("LargestFirst modified its input")
+	}
+}
+
+func TestRoundRobinDirs(t *testing.T) {
+	files := []string{"a/1", "a/2", "a/3", "b/1", "c/1", "c/2"}
+	got := RoundRobinDirs(files)
+	want := []string{"a/1", "b/1", "c/1", "a/2", "c/2", "a/3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("RoundRobinDirs = %v, want %v", got, want)
+	}
+}
+
+func TestByPriority(t *testing.T) {
+	schedule := ByPriority(func(file string) int {
+		if strings.HasSuffix(file, ".urgent") {
+			return 1
+		}
+		return 0
+	})
+	got := schedule([]string{"a", "b.urgent", "c", "d.urgent"})
+	want := []string{"b.urgent", "d.urgent", "a", "c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ByPriority = %v, want %v", got, want)
+	}
+}
+
+func TestStartFileProducerSchedule(t *testing.T) {
+	reverse := func(files []string) []string {
+		out := make([]string, len(files))
+		for i, f := range files {
+			out[len(files)-1-i] = f
+		}
+		return out
+	}
+	var got []string
+	for job := range StartFileProducer(context.Background(), []string{"a", "b", "c"}, WithSchedule(reverse)) {
+		got = append(got, job.Path)
+	}
+	if want := []string{"c", "b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("produced %v, want %v", got, want)
+	}
+}
+
+func TestPipelineScheduleWithInputOrder(t *testing.T) {
+	dir, files, cleanup := createFakeLogFiles(t, 3, 500)
+	defer cleanup()
+	big := filepath.Join(dir, "big.log")
+	if err := os.WriteFile(big, []byte(strings.Repeat("x\n", 100000)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sources := append(files, big)
+
+	var order []string
+	p := &Pipeline[string]{
+		Sources:       sources,
+		ReaderWorkers: 2,
+		ChunkSize:     1024,
+		InputOrder:    true,
+		ReorderLimits: ReorderLimits{MaxChunks: 2},
+		Schedule:      LargestFirst,
+		Processor: func(chunk FileChunk) ([]string, error) {
+			return []string{chunk.File}, nil
+		},
+		Sink: func(file string, _ []string) error {
+			if len(order) == 0 || order[len(order)-1] != file {
+				order = append(order, file)
+			}
+			return nil
+		},
+	}
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if want := LargestFirst(sources); !reflect.DeepEqual(order, want) {
+		t.Fatalf("files emitted in order %v, want %v", order, want)
+	}
+	if order[0] != big {
+		t.Fatalf("expected %s first, got %v", big, order)
+	}
+}
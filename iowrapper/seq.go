@@ -0,0 +1,76 @@
+package iowrapper
+
+import (
+	"context"
+	"errors"
+	"iter"
+)
+
+// errSeqStopped is returned by the sink of Seq when the consumer breaks out of the range loop.
+var errSeqStopped = errors.New("iowrapper: iteration stopped")
+
+// Seq is the iterator form of Run: it reads the files yielded by sources with the pipeline's settings
+// and yields every item, in chunk order per file and with files in the order of sources. Sources,
+// Sink, InputOrder and Schedule are ignored; sources is consumed lazily as the readers need more
+// files, and duplicates are skipped.
+//
+// A failed run yields a final (zero, err) pair carrying the same error Run would return. Breaking out
+// of the range loop cancels the run, and the loop statement only completes once every stage has exited.
+func (p *Pipeline[T]) Seq(ctx context.Context, sources iter.Seq[string]) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+		if p.Processor == nil {
+			yield(zero, errors.New("iowrapper: pipeline has no processor"))
+			return
+		}
+		if p.Progress != nil {
+			p.Progress.start(p.FS, nil)
+			defer p.Progress.Stop()
+		}
+
+		order := &orderLog{}
+		opts := append(p.stageOptions(), func(o *stageOptions) { o.orderLog = order })
+		produce := func(ctx context.Context) <-chan FileJob {
+			out := make(chan FileJob)
+			go func() {
+				defer close(out)
+				for source := range sources {
+					if p.Checkpoint != nil && p.Checkpoint.done(p.FS, source) {
+						continue
+					}
+					if !order.add(source) {
+						continue
+					}
+					p.Progress.add(source)
+					select {
+					case <-ctx.Done():
+						return
+					case out <- FileJob{Path: source}:
+					}
+				}
+			}()
+			return out
+		}
+
+		stopped := false
+		err := p.run(ctx, produce, func(_ string, items []T) error {
+			for _, item := range items {
+				if !yield(item, nil) {
+					stopped = true
+					return errSeqStopped
+				}
+			}
+			return nil
+		}, opts)
+		if err != nil && !stopped {
+			yield(zero, err)
+		}
+	}
+}
+
+// ProcessSeq processes the files yielded by sources in parallel with processor and yields the items
+// in order. It runs a Pipeline with default settings; use Pipeline.Seq to configure it.
+func ProcessSeq[T any](ctx context.Context, sources iter.Seq[string], processor ChunkProcessorFunc[T]) iter.Seq2[T, error] {
+	p := &Pipeline[T]{Processor: processor}
+	return p.Seq(ctx, sources)
+}
@@ -0,0 +1,151 @@
+package iowrapper
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestProcessSeqOrdered(t *testing.T) {
+	const linesPerFile = 3000
+
+	_, files, cleanup := createFakeLogFiles(t, 4, linesPerFile)
+	defer cleanup()
+
+	var got []FakeLogRecord
+	for rec, err := range ProcessSeq(context.Background(), slices.Values(files), parseChunkToFakeLogRecords) {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got = append(got, rec)
+	}
+
+	if len(got) != len(files)*linesPerFile {
+		t.Fatalf("got %d records, want %d", len(got), len(files)*linesPerFile)
+	}
+	for i, rec := range got {
+		file, index := i/linesPerFile, i%linesPerFile
+		if rec.File != files[file] || rec.Index != index {
+			t.Fatalf("record %d = %s/%d, want %s/%d", i, rec.File, rec.Index, files[file], index)
+		}
+	}
+}
+
+func TestPipelineSeqBreakCleansUp(t *testing.T) {
+	_, files, cleanup := createFakeLogFiles(t, 20, 5000)
+	defer cleanup()
+
+	before := runtime.NumGoroutine()
+
+	pulled := 0
+	sources := func(yield func(string) bool) {
+		for _, file := range files {
+			pulled++
+			if !yield(file) {
+				return
+			}
+		}
+	}
+
+	rec := newHookRecorder()
+	p := &Pipeline[FakeLogRecord]{
+		ReaderWorkers:    2,
+		ProcessorWorkers: 4,
+		ChunkSize:        4 * 1024,
+		Processor:        parseChunkToFakeLogRecords,
+		Hooks:            rec.hooks(),
+	}
+	n := 0
+	for _, err := range p.Seq(context.Background(), sources) {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		n++
+		if n == 10 {
+			break
+		}
+	}
+
+	waitForGoroutines(t, before)
+	if pulled == len(files) {
+		t.Fatal("every source was pulled although the loop stopped after the first file")
+	}
+	if len(rec.failed) != 0 {
+		t.Fatalf("breaking out reported failures: %v", rec.failed)
+	}
+}
+
+func TestPipelineSeqReportsErrors(t *testing.T) {
+	dir, files, cleanup := createFakeLogFiles(t, 2, 1000)
+	defer cleanup()
+	missing := filepath.Join(dir, "missing.log")
+	sources := []string{files[0], missing, files[1], files[0]}
+
+	p := &Pipeline[FakeLogRecord]{
+		FailurePolicy: ContinueOnError,
+		Processor:     parseChunkToFakeLogRecords,
+	}
+	var records int
+	var errs []error
+	for rec, err := range p.Seq(context.Background(), slices.Values(sources)) {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(errs) > 0 {
+			t.Fatalf("record %+v yielded after the error", rec)
+		}
+		records++
+	}
+
+	if records != 2000 {
+		t.Fatalf("got %d records, want 2000 (duplicates skipped)", records)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], os.ErrNotExist) {
+		t.Fatalf("expected a single os.ErrNotExist, got %v", errs)
+	}
+	var report *FailureReport
+	if !errors.As(errs[0], &report) || !slices.Equal(report.Files(), []string{missing}) {
+		t.Fatalf("expected a report for %s, got %v", missing, errs[0])
+	}
+}
+
+func TestPipelineSeqRereadsChangedFiles(t *testing.T) {
+	dir, files, cleanup := createFakeLogFiles(t, 2, 100)
+	defer cleanup()
+	statePath := filepath.Join(dir, "state.json")
+
+	count := func() int {
+		cp, err := LoadCheckpoint(statePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &Pipeline[FakeLogRecord]{Checkpoint: cp, Processor: parseChunkToFakeLogRecords}
+		n := 0
+		for _, err := range p.Seq(context.Background(), slices.Values(files)) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			n++
+		}
+		return n
+	}
+
+	if n := count(); n != 200 {
+		t.Fatalf("first run yielded %d records, want 200", n)
+	}
+	if n := count(); n != 0 {
+		t.Fatalf("rerun yielded %d records, want none", n)
+	}
+	// Rotate the first file: the checkpoint no longer describes it.
+	if err := writeFakeLogFile(files[0], filepath.Base(files[0]), 50); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 50 {
+		t.Fatalf("run after rotation yielded %d records, want 50", n)
+	}
+}
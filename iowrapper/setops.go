@@ -0,0 +1,241 @@
+package iowrapper
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SetOp selects the lines kept by SetOperation.
+type SetOp int
+
+const (
+	// Union keeps the lines found in any source.
+	Union SetOp = iota
+	// Intersection keeps the lines found in every source.
+	Intersection
+	// Difference keeps the lines of the first source that are in none of the others.
+	Difference
+	// SymmetricDifference keeps the lines found in exactly one source.
+	SymmetricDifference
+)
+
+func (op SetOp) String() string {
+	switch op {
+	case Union:
+		return "union"
+	case Intersection:
+		return "intersection"
+	case Difference:
+		return "difference"
+	case SymmetricDifference:
+		return "symmetric-difference"
+	default:
+		return fmt.Sprintf("SetOp(%d)", int(op))
+	}
+}
+
+// SetOperation combines sources, which must each be sorted by compare (byte order when nil), and calls
+// emit with the lines kept by op, in sorted order. The sources are streamed side by side, so memory
+// use does not depend on their size; they may be compressed and "-" reads stdin. Lines repeated
+// within a source count once, and of lines that compare equal the one from the first source having
+// it is emitted. A source found out of order fails the operation.
+func SetOperation(ctx context.Context, op SetOp, compare LineCompare, sources []string, emit func(line string) error) error {
+	if len(sources) == 0 {
+		return errors.New("iowrapper: set operation without sources")
+	}
+	if op < Union || op > SymmetricDifference {
+		return fmt.Errorf("iowrapper: unknown set operation %v", op)
+	}
+	return mergeSorted(ctx, compare, sources, func(line string, in []bool) error {
+		count := 0
+		for _, ok := range in {
+			if ok {
+				count++
+			}
+		}
+		var keep bool
+		switch op {
+		case Union:
+			keep = true
+		case Intersection:
+			keep = count == len(in)
+		case Difference:
+			keep = in[0] && count == 1
+		case SymmetricDifference:
+			keep = count == 1
+		}
+		if !keep {
+			return nil
+		}
+		return emit(line)
+	})
+}
+
+// SetOperationTo is SetOperation writing the lines to dest, with Writer's handling of compression
+// suffixes and "-" for stdout.
+func SetOperationTo(ctx context.Context, op SetOp, compare LineCompare, sources []string, dest string) error {
+	return writeLines(dest, func(emit func(string) error) error {
+		return SetOperation(ctx, op, compare, sources, emit)
+	})
+}
+
+// Comm compares the sorted sources a and b like comm(1) and calls emit with every line and its
+// column: 1 for lines only in a, 2 for lines only in b and 3 for lines in both. The sources are
+// handled as by SetOperation.
+func Comm(ctx context.Context, compare LineCompare, a, b string, emit func(column int, line string) error) error {
+	return mergeSorted(ctx, compare, []string{a, b}, func(line string, in []bool) error {
+		switch {
+		case in[0] && in[1]:
+			return emit(3, line)
+		case in[0]:
+			return emit(1, line)
+		default:
+			return emit(2, line)
+		}
+	})
+}
+
+// CommTo is Comm writing comm(1) output to dest: the lines of the given columns, all three when
+// none are given, each indented by one tab per selected column before its own.
+func CommTo(ctx context.Context, compare LineCompare, a, b, dest string, columns ...int) error {
+	if len(columns) == 0 {
+		columns = []int{1, 2, 3}
+	}
+	var shown [4]bool
+	for _, c := range columns {
+		if c < 1 || c > 3 {
+			return fmt.Errorf("iowrapper: invalid comm column %d", c)
+		}
+		shown[c] = true
+	}
+	return writeLines(dest, func(emit func(string) error) error {
+		return Comm(ctx, compare, a, b, func(column int, line string) error {
+			if !shown[column] {
+				return nil
+			}
+			indent := 0
+			for c := 1; c < column; c++ {
+				if shown[c] {
+					indent++
+				}
+			}
+			return emit(strings.Repeat("\t", indent) + line)
+		})
+	})
+}
+
+// writeLines opens dest with Writer and passes write a function writing one line to it.
+func writeLines(dest string, write func(emit func(string) error) error) error {
+	w, closer, err := Writer(dest, 256*1024)
+	if err != nil {
+		return err
+	}
+	err = write(func(line string) error {
+		if _, err := w.WriteString(line); err != nil {
+			return err
+		}
+		return w.WriteByte('\n')
+	})
+	if cerr := closer.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// mergeSorted walks the sorted sources side by side and calls fn once for every distinct line, with
+// the sources it was found in marked in in. in is reused between calls.
+func mergeSorted(ctx context.Context, compare LineCompare, sources []string, fn func(line string, in []bool) error) error {
+	if compare == nil {
+		compare = strings.Compare
+	}
+	heads := make([]*sortedSource, 0, len(sources))
+	defer func() {
+		for _, src := range heads {
+			src.closer.Close()
+		}
+	}()
+	for _, source := range sources {
+		r, closer, err := Reader(source, 256*1024)
+		if err != nil {
+			return fmt.Errorf("open %s: %w", source, err)
+		}
+		src := &sortedSource{name: source, r: r, closer: closer, compare: compare}
+		heads = append(heads, src)
+		if err := src.next(); err != nil {
+			return err
+		}
+	}
+
+	in := make([]bool, len(heads))
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var lowest *sortedSource
+		for _, src := range heads {
+			if src.ok && (lowest == nil || compare(src.head, lowest.head) < 0) {
+				lowest = src
+			}
+		}
+		if lowest == nil {
+			return nil
+		}
+		line := lowest.head
+		for i, src := range heads {
+			in[i] = src.ok && compare(src.head, line) == 0
+		}
+		if err := fn(line, in); err != nil {
+			return err
+		}
+		for i, src := range heads {
+			if in[i] {
+				if err := src.next(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// sortedSource reads the distinct lines of a sorted source, checking their order.
+type sortedSource struct {
+	name    string
+	r       *bufio.Reader
+	closer  io.Closer
+	compare LineCompare
+
+	head string
+	ok   bool
+	line int64
+}
+
+// next moves to the next line that differs from the current one; ok is false at the end.
+func (s *sortedSource) next() error {
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("read %s: %w", s.name, err)
+		}
+		if line == "" && err == io.EOF {
+			s.ok = false
+			return nil
+		}
+		s.line++
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if s.line > 1 {
+			c := s.compare(s.head, line)
+			if c > 0 {
+				return fmt.Errorf("%s: line %d is out of order", s.name, s.line)
+			}
+			if c == 0 {
+				continue
+			}
+		}
+		s.head, s.ok = line, true
+		return nil
+	}
+}
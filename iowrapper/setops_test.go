@@ -0,0 +1,147 @@
+package iowrapper
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeSortedFixtures(t *testing.T) (string, []string) {
+	t.Helper()
+	dir := t.TempDir()
+	files := []struct {
+		name string
+		data string
+	}{
+		{"a.txt", "apple\nbanana\nbanana\ncherry\n"},
+		{"b.txt.gz", "banana\ndate\n"},
+		{"c.txt.zst", "banana\ncherry\nelder\n"},
+	}
+	var paths []string
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		data := []byte(f.data)
+		switch filepath.Ext(f.name) {
+		case ".gz":
+			data = gzipBytes(t, f.data)
+		case ".zst":
+			data = zstdBytes(t, f.data)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return dir, paths
+}
+
+func TestSetOperation(t *testing.T) {
+	_, sources := writeSortedFixtures(t)
+	for _, tc := range []struct {
+		op   SetOp
+		want []string
+	}{
+		{Union, []string{"apple", "banana", "cherry", "date", "elder"}},
+		{Intersection, []string{"banana"}},
+		{Difference, []string{"apple"}},
+		{SymmetricDifference, []string{"apple", "date", "elder"}},
+	} {
+		t.Run(tc.op.String(), func(t *testing.T) {
+			var got []string
+			err := SetOperation(context.Background(), tc.op, nil, sources, func(line string) error {
+				got = append(got, line)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSetOperationTo(t *testing.T) {
+	dir, sources := writeSortedFixtures(t)
+	dest := filepath.Join(dir, "out.txt.gz")
+	if err := SetOperationTo(context.Background(), Intersection, nil, sources[:2], dest); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadLines(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"banana"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestSetOperationCompare(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	if err := os.WriteFile(a, []byte("9.0.0.1\n10.0.0.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(b, []byte("10.0.0.1\n100.0.0.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	if err := SetOperation(context.Background(), Union, CompareIP, []string{a, b}, func(line string) error {
+		got = append(got, line)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"9.0.0.1", "10.0.0.1", "100.0.0.1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// In byte order the same file is unsorted.
+	err := SetOperation(context.Background(), Union, nil, []string{a}, func(string) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "out of order") {
+		t.Fatalf("expected an order error, got %v", err)
+	}
+}
+
+func TestComm(t *testing.T) {
+	dir, sources := writeSortedFixtures(t)
+	var got []string
+	if err := Comm(context.Background(), nil, sources[0], sources[2], func(column int, line string) error {
+		got = append(got, strings.Repeat("-", column)+line)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"-apple", "---banana", "---cherry", "--elder"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	dest := filepath.Join(dir, "comm.txt")
+	for _, tc := range []struct {
+		columns []int
+		want    string
+	}{
+		{nil, "apple\n\t\tbanana\n\t\tcherry\n\telder\n"},
+		{[]int{2, 3}, "\tbanana\n\tcherry\nelder\n"},
+		{[]int{3}, "banana\ncherry\n"},
+	} {
+		if err := CommTo(context.Background(), nil, sources[0], sources[2], dest, tc.columns...); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tc.want {
+			t.Fatalf("columns %v: got %q, want %q", tc.columns, data, tc.want)
+		}
+	}
+	if err := CommTo(context.Background(), nil, sources[0], sources[2], dest, 4); err == nil {
+		t.Fatal("expected an error for column 4")
+	}
+}
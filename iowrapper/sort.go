@@ -0,0 +1,439 @@
+package iowrapper
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Defaults used by Sorter.
+const (
+	DefaultSortMemory = 256 * 1024 * 1024
+	DefaultSortFanIn  = 128
+)
+
+// LineCompare orders two lines: negative when a sorts before b, zero when they are equal and
+// positive otherwise.
+type LineCompare func(a, b string) int
+
+// CompareIP orders IP addresses and prefixes numerically, IPv4 before IPv6 and a prefix before the
+// address it starts with, shorter prefixes first. Lines that are neither sort after all addresses, in
+// byte order.
+func CompareIP(a, b string) int {
+	pa, okA := parseIPKey(a)
+	pb, okB := parseIPKey(b)
+	switch {
+	case okA && okB:
+		if c := pa.Addr().Compare(pb.Addr()); c != 0 {
+			return c
+		}
+		// A plain address is stored as a full-length prefix; order shorter prefixes first.
+		if c := pa.Bits() - pb.Bits(); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	case okA:
+		return -1
+	case okB:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func parseIPKey(s string) (netip.Prefix, bool) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix, true
+	}
+	return netip.Prefix{}, false
+}
+
+// CompareReversedDomain orders domain names label by label from the right, so that every domain
+// sorts right after its parent: "example.com" < "a.example.com" < "b.example.com" < "example.org".
+func CompareReversedDomain(a, b string) int {
+	a, b = strings.TrimSuffix(a, "."), strings.TrimSuffix(b, ".")
+	for a != "" && b != "" {
+		var la, lb string
+		if i := strings.LastIndexByte(a, '.'); i >= 0 {
+			a, la = a[:i], a[i+1:]
+		} else {
+			a, la = "", a
+		}
+		if i := strings.LastIndexByte(b, '.'); i >= 0 {
+			b, lb = b[:i], b[i+1:]
+		} else {
+			b, lb = "", b
+		}
+		if c := strings.Compare(la, lb); c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// Reverse returns a LineCompare that sorts in the opposite order of compare.
+func Reverse(compare LineCompare) LineCompare {
+	return func(a, b string) int { return compare(b, a) }
+}
+
+// Sorter sorts the lines of sources that do not fit in memory, like sort(1). Lines are collected into
+// runs of about MemoryLimit/(Workers+1) bytes, which Workers goroutines sort and spill to
+// zstd-compressed temporary files while the next run is read; the runs are then combined with a
+// k-way merge. The sort is stable: lines that compare equal keep their input order.
+type Sorter struct {
+	// Compare orders the lines. Defaults to byte order.
+	Compare LineCompare
+	// Unique keeps only the first of the lines that compare equal.
+	Unique bool
+	// MemoryLimit is roughly the memory used for lines, in bytes. Defaults to DefaultSortMemory.
+	MemoryLimit int64
+	// Workers is the number of runs sorted and spilled concurrently. Defaults to runtime.NumCPU().
+	Workers int
+	// FanIn is the number of runs merged at once. With more runs than that, groups of runs are first
+	// merged into larger ones. Defaults to DefaultSortFanIn.
+	FanIn int
+	// TempDir is where spill files are created. Defaults to os.TempDir().
+	TempDir string
+}
+
+// Sort reads the lines of sources, which may be compressed and "-" for stdin, and calls emit with
+// each line in sorted order, without its line ending. Spill files are removed before Sort returns.
+func (s *Sorter) Sort(ctx context.Context, sources []string, emit func(line string) error) error {
+	compare := s.compare()
+	workers := s.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	memory := s.MemoryLimit
+	if memory <= 0 {
+		memory = DefaultSortMemory
+	}
+	runLimit := max(memory/int64(workers+1), 1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		spills   []string
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+	defer func() {
+		for _, path := range spills {
+			if path != "" {
+				_ = os.Remove(path)
+			}
+		}
+	}()
+
+	type sortRun struct {
+		index int
+		lines []string
+	}
+	runs := make(chan sortRun)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for run := range runs {
+				path, err := s.spill(s.sortLines(run.lines, compare))
+				mu.Lock()
+				spills[run.index] = path
+				mu.Unlock()
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	var last []string
+	readErr := s.readRuns(ctx, sources, runLimit, func(lines []string) bool {
+		mu.Lock()
+		index := len(spills)
+		spills = append(spills, "")
+		mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return false
+		case runs <- sortRun{index: index, lines: lines}:
+			return true
+		}
+	}, &last)
+	close(runs)
+	wg.Wait()
+
+	// A failed spill cancels the reading, so report it first.
+	if firstErr != nil {
+		return firstErr
+	}
+	if readErr != nil {
+		return readErr
+	}
+
+	for len(spills) > s.fanIn() {
+		var merged []string
+		for i := 0; i < len(spills); i += s.fanIn() {
+			group := spills[i:min(i+s.fanIn(), len(spills))]
+			path, err := s.mergeToSpill(ctx, group, compare)
+			for j := range group {
+				_ = os.Remove(group[j])
+				group[j] = ""
+			}
+			merged = append(merged, path)
+			if err != nil {
+				spills = append(spills, merged...)
+				return err
+			}
+		}
+		spills = merged
+	}
+	return s.merge(ctx, spills, s.sortLines(last, compare), compare, emit)
+}
+
+// SortTo is Sort writing the sorted lines to dest, with Writer's handling of compression suffixes
+// and "-" for stdout.
+func (s *Sorter) SortTo(ctx context.Context, sources []string, dest string) error {
+	return writeLines(dest, func(emit func(string) error) error {
+		return s.Sort(ctx, sources, emit)
+	})
+}
+
+func (s *Sorter) compare() LineCompare {
+	if s.Compare == nil {
+		return strings.Compare
+	}
+	return s.Compare
+}
+
+func (s *Sorter) fanIn() int {
+	if s.FanIn < 2 {
+		return DefaultSortFanIn
+	}
+	return s.FanIn
+}
+
+// readRuns reads the lines of sources and hands them to spill in runs of about limit bytes. The
+// final, partial run is left in last. It stops early when spill returns false.
+func (s *Sorter) readRuns(ctx context.Context, sources []string, limit int64, spill func([]string) bool, last *[]string) error {
+	var (
+		lines []string
+		size  int64
+	)
+	for _, source := range sources {
+		r, closer, err := Reader(source, 256*1024)
+		if err != nil {
+			return fmt.Errorf("open %s: %w", source, err)
+		}
+		for {
+			line, err := r.ReadString('\n')
+			if line != "" {
+				line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+				lines = append(lines, line)
+				// Count the string header as well as the data.
+				size += int64(len(line)) + 16
+				if size >= limit {
+					if !spill(lines) {
+						closer.Close()
+						return ctx.Err()
+					}
+					lines, size = nil, 0
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				closer.Close()
+				return fmt.Errorf("read %s: %w", source, err)
+			}
+		}
+		closer.Close()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	*last = lines
+	return nil
+}
+
+// sortLines sorts lines stably and, in unique mode, drops all but the first of equal lines.
+func (s *Sorter) sortLines(lines []string, compare LineCompare) []string {
+	slices.SortStableFunc(lines, compare)
+	if s.Unique {
+		lines = slices.CompactFunc(lines, func(a, b string) bool { return compare(a, b) == 0 })
+	}
+	return lines
+}
+
+// spill writes sorted lines to a new zstd-compressed temporary file.
+func (s *Sorter) spill(lines []string) (string, error) {
+	return s.writeSpill(func(emit func(string) error) error {
+		for _, line := range lines {
+			if err := emit(line); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// mergeToSpill merges the given spill files into a new one.
+func (s *Sorter) mergeToSpill(ctx context.Context, paths []string, compare LineCompare) (string, error) {
+	return s.writeSpill(func(emit func(string) error) error {
+		return s.merge(ctx, paths, nil, compare, emit)
+	})
+}
+
+func (s *Sorter) writeSpill(write func(emit func(string) error) error) (string, error) {
+	f, err := os.CreateTemp(s.TempDir, "sort-run-*.zst")
+	if err != nil {
+		return "", fmt.Errorf("create spill file: %w", err)
+	}
+	path := f.Name()
+	w, closer, err := compressWriter(f, zstandard, 256*1024)
+	if err != nil {
+		return path, fmt.Errorf("create spill file: %w", err)
+	}
+	err = write(func(line string) error {
+		if _, err := w.WriteString(line); err != nil {
+			return err
+		}
+		return w.WriteByte('\n')
+	})
+	if cerr := closer.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return path, fmt.Errorf("write spill file: %w", err)
+	}
+	return path, nil
+}
+
+// lineRun iterates over the lines of one sorted run, either in memory or in a spill file.
+type lineRun struct {
+	head  string
+	index int
+
+	mem    []string
+	r      *bufio.Reader
+	closer io.Closer
+}
+
+func (l *lineRun) next() (bool, error) {
+	if l.r == nil {
+		if len(l.mem) == 0 {
+			return false, nil
+		}
+		l.head, l.mem = l.mem[0], l.mem[1:]
+		return true, nil
+	}
+	line, err := l.r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return false, nil
+	}
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("read spill file: %w", err)
+	}
+	l.head = strings.TrimSuffix(line, "\n")
+	return true, nil
+}
+
+// lineHeap orders runs by their head line, and equal lines by run, which keeps the merge stable.
+type lineHeap struct {
+	runs    []*lineRun
+	compare LineCompare
+}
+
+func (h *lineHeap) Len() int { return len(h.runs) }
+func (h *lineHeap) Less(i, j int) bool {
+	if c := h.compare(h.runs[i].head, h.runs[j].head); c != 0 {
+		return c < 0
+	}
+	return h.runs[i].index < h.runs[j].index
+}
+func (h *lineHeap) Swap(i, j int) { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+func (h *lineHeap) Push(x any)    { h.runs = append(h.runs, x.(*lineRun)) }
+func (h *lineHeap) Pop() any {
+	run := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return run
+}
+
+// merge performs a k-way merge of the spill files, in input order, followed by the in-memory run.
+func (s *Sorter) merge(ctx context.Context, paths []string, mem []string, compare LineCompare, emit func(string) error) error {
+	var runs []*lineRun
+	defer func() {
+		for _, run := range runs {
+			if run.closer != nil {
+				run.closer.Close()
+			}
+		}
+	}()
+	for _, path := range paths {
+		r, closer, err := Reader(path, 64*1024)
+		if err != nil {
+			return fmt.Errorf("open spill file: %w", err)
+		}
+		runs = append(runs, &lineRun{index: len(runs), r: r, closer: closer})
+	}
+	runs = append(runs, &lineRun{index: len(runs), mem: mem})
+
+	h := &lineHeap{compare: compare}
+	for _, run := range runs {
+		ok, err := run.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h.runs = append(h.runs, run)
+		}
+	}
+	heap.Init(h)
+
+	var previous string
+	emitted := false
+	for h.Len() > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		run := h.runs[0]
+		line := run.head
+		ok, err := run.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+		if s.Unique && emitted && compare(line, previous) == 0 {
+			continue
+		}
+		if err := emit(line); err != nil {
+			return err
+		}
+		previous, emitted = line, true
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package iowrapper
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSorterSpillsAndMerges(t *testing.T) {
+	dir := t.TempDir()
+	spillDir := t.TempDir()
+	rng := rand.New(rand.NewSource(1))
+
+	var all []string
+	var sources []string
+	for i := 0; i < 3; i++ {
+		var b strings.Builder
+		for j := 0; j < 3000; j++ {
+			line := fmt.Sprintf("%08d", rng.Intn(5000))
+			all = append(all, line)
+			b.WriteString(line + "\n")
+		}
+		path := filepath.Join(dir, fmt.Sprintf("part%d.txt", i))
+		data := []byte(b.String())
+		if i == 1 {
+			path += ".gz"
+			data = gzipBytes(t, b.String())
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, path)
+	}
+
+	for _, unique := range []bool{false, true} {
+		s := &Sorter{MemoryLimit: 16 * 1024, Workers: 3, FanIn: 4, TempDir: spillDir, Unique: unique}
+		var got []string
+		if err := s.Sort(context.Background(), sources, func(line string) error {
+			got = append(got, line)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		want := slices.Clone(all)
+		slices.Sort(want)
+		if unique {
+			want = slices.Compact(want)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unique=%v: got %d lines, want %d", unique, len(got), len(want))
+		}
+		if entries, _ := os.ReadDir(spillDir); len(entries) != 0 {
+			t.Fatalf("spill files left behind: %v", entries)
+		}
+	}
+}
+
+func TestSorterIsStable(t *testing.T) {
+	dir := t.TempDir()
+	var b strings.Builder
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&b, "key%d %d\n", i%7, i)
+	}
+	path := filepath.Join(dir, "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	byKey := func(a, b string) int {
+		return strings.Compare(strings.Fields(a)[0], strings.Fields(b)[0])
+	}
+
+	s := &Sorter{Compare: byKey, MemoryLimit: 4 * 1024, Workers: 2, FanIn: 3, TempDir: t.TempDir()}
+	var got []string
+	if err := s.Sort(context.Background(), []string{path}, func(line string) error {
+		got = append(got, line)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(got); i++ {
+		a, b := strings.Fields(got[i-1]), strings.Fields(got[i])
+		na, _ := strconv.Atoi(a[1])
+		nb, _ := strconv.Atoi(b[1])
+		if a[0] == b[0] && na > nb {
+			t.Fatalf("equal keys out of input order: %q before %q", got[i-1], got[i])
+		}
+	}
+
+	s.Unique = true
+	got = nil
+	if err := s.Sort(context.Background(), []string{path}, func(line string) error {
+		got = append(got, line)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"key0 0", "key1 1", "key2 2", "key3 3", "key4 4", "key5 5", "key6 6"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unique kept %v, want %v", got, want)
+	}
+}
+
+func TestSorterSortTo(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "domains.txt")
+	if err := os.WriteFile(in, []byte("b.example.com\nexample.org\nexample.com\na.example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "sorted.txt.zst")
+	s := &Sorter{Compare: CompareReversedDomain}
+	if err := s.SortTo(context.Background(), []string{in}, out); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadLines(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"example.com", "a.example.com", "b.example.com", "example.org"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	if err := s.SortTo(context.Background(), []string{filepath.Join(dir, "missing.txt")}, out); err == nil {
+		t.Fatal("expected an error for a missing source")
+	}
+}
+
+func TestLineCompares(t *testing.T) {
+	lines := []string{"10.0.0.10", "not an ip", "::1", "10.0.0.0/8", "10.0.0.0", "9.255.255.255", "10.0.0.2"}
+	slices.SortStableFunc(lines, CompareIP)
+	if want := []string{"9.255.255.255", "10.0.0.0/8", "10.0.0.0", "10.0.0.2", "10.0.0.10", "::1", "not an ip"}; !reflect.DeepEqual(lines, want) {
+		t.Fatalf("CompareIP order %v, want %v", lines, want)
+	}
+
+	domains := []string{"com", "b.a.com", "a.com.", "z.org", "a.com"}
+	slices.SortStableFunc(domains, CompareReversedDomain)
+	if want := []string{"com", "a.com.", "a.com", "b.a.com", "z.org"}; !reflect.DeepEqual(domains, want) {
+		t.Fatalf("CompareReversedDomain order %v, want %v", domains, want)
+	}
+
+	desc := []string{"a", "c", "b"}
+	slices.SortFunc(desc, Reverse(strings.Compare))
+	if want := []string{"c", "b", "a"}; !reflect.DeepEqual(desc, want) {
+		t.Fatalf("Reverse order %v, want %v", desc, want)
+	}
+}
@@ -0,0 +1,196 @@
+package iowrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrSinkDetached is reported for a TeeDetach sink that could not keep up and was cut off.
+var ErrSinkDetached = errors.New("sink too slow, detached")
+
+// TeeMode decides what happens to the other sinks of a tee when one sink is slow or fails.
+type TeeMode int
+
+const (
+	// TeeBlock applies backpressure: a slow sink holds back every sink, and a failing sink stops the tee.
+	TeeBlock TeeMode = iota
+	// TeeDetach cuts the sink off when its buffer stays full or it fails; the other sinks keep going.
+	TeeDetach
+)
+
+func (m TeeMode) String() string {
+	switch m {
+	case TeeBlock:
+		return "block"
+	case TeeDetach:
+		return "detach"
+	default:
+		return fmt.Sprintf("TeeMode(%d)", int(m))
+	}
+}
+
+// TeeSink is one branch of a tee.
+type TeeSink[T any] struct {
+	// Name identifies the sink in errors.
+	Name string
+	// Buffer is the number of chunks queued for the sink.
+	Buffer int
+	// Mode decides whether a slow or failing sink blocks the others or is detached.
+	Mode TeeMode
+	// Timeout is how long a TeeDetach sink may hold back a chunk once its buffer is full before it is
+	// detached. Zero detaches it as soon as the buffer is full.
+	Timeout time.Duration
+	// Consume reads the branch until it is closed, e.g. by calling StreamOrdered or Reducer.Run.
+	// Returning early stops delivery to this sink.
+	Consume func(ctx context.Context, in <-chan ProcessedChunk[T]) error
+}
+
+// TeeError records the failure of a single tee sink.
+type TeeError struct {
+	Sink string
+	Err  error
+}
+
+func (e *TeeError) Error() string {
+	return fmt.Sprintf("tee sink %s: %v", e.Sink, e.Err)
+}
+
+func (e *TeeError) Unwrap() error {
+	return e.Err
+}
+
+type teeBranch[T any] struct {
+	sink TeeSink[T]
+	ch   chan ProcessedChunk[T]
+	done chan struct{}
+
+	closed bool
+	slow   bool  // set by the tee loop
+	err    error // set by the sink goroutine
+}
+
+// Tee copies every chunk of in to each sink. Sinks share the chunks and must not modify Items.
+// It returns once in is closed and every sink has returned, joining the errors of all sinks as
+// *TeeError values. Chunks that arrive after every sink has stopped are drained and dropped. When a
+// TeeBlock sink fails, the tee stops early and the caller must cancel ctx so that the upstream
+// stages exit.
+func Tee[T any](ctx context.Context, in <-chan ProcessedChunk[T], sinks ...TeeSink[T]) error {
+	for i, sink := range sinks {
+		if sink.Consume == nil {
+			return fmt.Errorf("iowrapper: tee sink %d (%s) has no Consume", i, sink.Name)
+		}
+	}
+
+	teeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	branches := make([]*teeBranch[T], len(sinks))
+	var wg sync.WaitGroup
+	wg.Add(len(sinks))
+	for i, sink := range sinks {
+		b := &teeBranch[T]{
+			sink: sink,
+			ch:   make(chan ProcessedChunk[T], max(sink.Buffer, 0)),
+			done: make(chan struct{}),
+		}
+		branches[i] = b
+		go func() {
+			defer wg.Done()
+			defer close(b.done)
+			err := sink.Consume(teeCtx, b.ch)
+			if err == nil || (isContextErr(err) && teeCtx.Err() != nil) {
+				return
+			}
+			b.err = err
+			if sink.Mode == TeeBlock {
+				cancel()
+			}
+		}()
+	}
+
+	detach := func(b *teeBranch[T]) {
+		if !b.closed {
+			b.closed = true
+			close(b.ch)
+		}
+	}
+
+loop:
+	for {
+		select {
+		case <-teeCtx.Done():
+			break loop
+		case res, ok := <-in:
+			if !ok {
+				break loop
+			}
+			// With every branch detached the chunks are discarded, so that upstream never blocks.
+			for _, b := range branches {
+				if b.closed {
+					continue
+				}
+				if !b.send(teeCtx, res) {
+					detach(b)
+				}
+			}
+		}
+	}
+	for _, b := range branches {
+		detach(b)
+	}
+	wg.Wait()
+
+	var errs []error
+	for _, b := range branches {
+		switch {
+		case b.err != nil:
+			errs = append(errs, &TeeError{Sink: b.sink.Name, Err: b.err})
+		case b.slow:
+			errs = append(errs, &TeeError{Sink: b.sink.Name, Err: ErrSinkDetached})
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// send delivers res to the branch and reports whether the branch should stay attached.
+func (b *teeBranch[T]) send(ctx context.Context, res ProcessedChunk[T]) bool {
+	if b.sink.Mode == TeeBlock {
+		select {
+		case b.ch <- res:
+			return true
+		case <-b.done:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	select {
+	case b.ch <- res:
+		return true
+	case <-b.done:
+		return false
+	default:
+	}
+	if b.sink.Timeout > 0 {
+		timer := time.NewTimer(b.sink.Timeout)
+		defer timer.Stop()
+		select {
+		case b.ch <- res:
+			return true
+		case <-b.done:
+			return false
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+		}
+	}
+	b.slow = true
+	return false
+}
@@ -0,0 +1,187 @@
+package iowrapper
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func feedInts(n int) <-chan ProcessedChunk[int] {
+	ch := make(chan ProcessedChunk[int], n)
+	for i := 0; i < n; i++ {
+		ch <- ProcessedChunk[int]{File: "a", ChunkIndex: i, Items: []int{i}}
+	}
+	close(ch)
+	return ch
+}
+
+func countingSink(name string, mode TeeMode, count *int) TeeSink[int] {
+	return TeeSink[int]{
+		Name: name,
+		Mode: mode,
+		Consume: func(ctx context.Context, in <-chan ProcessedChunk[int]) error {
+			for range in {
+				*count++
+			}
+			return nil
+		},
+	}
+}
+
+func TestTeeFeedsEverySink(t *testing.T) {
+	const chunks = 100
+
+	var ordered []int
+	archive := TeeSink[int]{
+		Name:   "archive",
+		Buffer: 4,
+		Consume: func(ctx context.Context, in <-chan ProcessedChunk[int]) error {
+			return StreamOrdered(ctx, in, func(file string, items []int) error {
+				ordered = append(ordered, items...)
+				return nil
+			})
+		},
+	}
+	var counted int
+
+	err := Tee(context.Background(), feedInts(chunks), archive, countingSink("metrics", TeeBlock, &counted))
+	if err != nil {
+		t.Fatalf("Tee returned error: %v", err)
+	}
+	if counted != chunks || len(ordered) != chunks {
+		t.Fatalf("sinks saw %d and %d chunks, want %d", counted, len(ordered), chunks)
+	}
+	for i, v := range ordered {
+		if v != i {
+			t.Fatalf("archive out of order at %d: %v", i, ordered[:i+1])
+		}
+	}
+}
+
+func TestTeeDetachesSlowSink(t *testing.T) {
+	const chunks = 50
+
+	release := make(chan struct{})
+	slow := TeeSink[int]{
+		Name:   "slow",
+		Buffer: 2,
+		Mode:   TeeDetach,
+		Consume: func(ctx context.Context, in <-chan ProcessedChunk[int]) error {
+			<-release
+			for range in {
+			}
+			return nil
+		},
+	}
+	var counted int
+	fast := TeeSink[int]{
+		Name: "fast",
+		Consume: func(ctx context.Context, in <-chan ProcessedChunk[int]) error {
+			defer close(release)
+			for range in {
+				counted++
+			}
+			return nil
+		},
+	}
+
+	err := Tee(context.Background(), feedInts(chunks), slow, fast)
+	if !errors.Is(err, ErrSinkDetached) {
+		t.Fatalf("expected ErrSinkDetached, got %v", err)
+	}
+	var te *TeeError
+	if !errors.As(err, &te) || te.Sink != "slow" {
+		t.Fatalf("expected a TeeError for the slow sink, got %v", err)
+	}
+	if counted != chunks {
+		t.Fatalf("fast sink saw %d chunks, want %d", counted, chunks)
+	}
+}
+
+func TestTeeFailingSink(t *testing.T) {
+	sinkErr := errors.New("disk full")
+	failing := func(mode TeeMode) TeeSink[int] {
+		return TeeSink[int]{
+			Name: "archive",
+			Mode: mode,
+			Consume: func(ctx context.Context, in <-chan ProcessedChunk[int]) error {
+				<-in
+				return sinkErr
+			},
+		}
+	}
+
+	t.Run("detach", func(t *testing.T) {
+		var counted int
+		err := Tee(context.Background(), feedInts(20), failing(TeeDetach), countingSink("metrics", TeeBlock, &counted))
+		if !errors.Is(err, sinkErr) {
+			t.Fatalf("expected %v, got %v", sinkErr, err)
+		}
+		if counted != 20 {
+			t.Fatalf("metrics sink saw %d chunks, want 20", counted)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		in := make(chan ProcessedChunk[int])
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			for i := 0; ; i++ {
+				select {
+				case in <- ProcessedChunk[int]{File: "a", ChunkIndex: i}:
+				case <-stop:
+					return
+				}
+			}
+		}()
+		var seen []string
+		other := TeeSink[int]{
+			Name: "metrics",
+			Consume: func(ctx context.Context, in <-chan ProcessedChunk[int]) error {
+				for range in {
+				}
+				seen = append(seen, "closed")
+				return nil
+			},
+		}
+		err := Tee(context.Background(), in, failing(TeeBlock), other)
+		var te *TeeError
+		if !errors.As(err, &te) || te.Sink != "archive" || !errors.Is(err, sinkErr) {
+			t.Fatalf("expected TeeError for archive, got %v", err)
+		}
+		if !reflect.DeepEqual(seen, []string{"closed"}) {
+			t.Fatalf("other sink was not closed: %v", seen)
+		}
+	})
+}
+
+func TestTeeDrainsAfterEverySinkStopped(t *testing.T) {
+	const chunks = 50
+
+	in := make(chan ProcessedChunk[int])
+	sent := make(chan int)
+	go func() {
+		n := 0
+		for ; n < chunks; n++ {
+			in <- ProcessedChunk[int]{File: "a", ChunkIndex: n}
+		}
+		close(in)
+		sent <- n
+	}()
+	first := TeeSink[int]{
+		Name: "first",
+		Consume: func(ctx context.Context, in <-chan ProcessedChunk[int]) error {
+			<-in
+			return nil
+		},
+	}
+
+	if err := Tee(context.Background(), in, first); err != nil {
+		t.Fatalf("Tee returned error: %v", err)
+	}
+	if n := <-sent; n != chunks {
+		t.Fatalf("upstream sent %d chunks, want %d", n, chunks)
+	}
+}